@@ -0,0 +1,425 @@
+package wireguard
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// Client dials tunnels to one peer. The configuration is validated and its keys
+// decoded once, so dialing only costs the handshake. A Client is safe for
+// concurrent use; Rand in the configuration, when set, has to be as well.
+//
+// The peer keeps only the newest sessions of a key, so tunnels dialed at the
+// same time with the same keys replace each other. Exchange and ListenPacket
+// share a single tunnel instead.
+type Client struct {
+	config Configuration
+	random io.Reader
+	now    func() time.Time
+
+	privateKey              NoisePrivateKey
+	publicKey               NoisePublicKey
+	peerPublicKey           NoisePublicKey
+	presharedKey            NoisePresharedKey
+	precomputedStaticStatic [NoisePublicKeySize]byte
+
+	// holds the latest cookie from the peer, shared by all handshakes
+	cookieMutex     sync.Mutex
+	cookieGenerator CookieGenerator
+
+	initiationMutex sync.Mutex
+	lastInitiation  time.Time
+
+	sessionMutex sync.Mutex
+	session      *clientSession
+	dialing      *clientDial // the dial in progress for session, if any
+	closed       bool
+}
+
+func NewClient(config Configuration) (*Client, error) {
+	client := &Client{
+		config: config,
+		random: entropy(config.Rand),
+		now:    clock(config.Now),
+	}
+
+	err := decodeBase64(client.privateKey[:], config.PrivateKey)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidPrivateKey, err)
+	}
+	client.privateKey.clamp()
+	client.publicKey = client.privateKey.publicKey()
+
+	err = decodeBase64(client.peerPublicKey[:], config.PublicKey)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidPublicKey, err)
+	}
+
+	if config.PresharedKey != "" {
+		err = decodeBase64(client.presharedKey[:], config.PresharedKey)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidPresharedKey, err)
+		}
+	}
+
+	client.precomputedStaticStatic = client.privateKey.sharedSecret(client.peerPublicKey)
+	if isZero(client.precomputedStaticStatic[:]) {
+		return nil, ErrInvalidPublicKey
+	}
+
+	if config.ClientIpAddress != "" && net.ParseIP(config.ClientIpAddress) == nil {
+		return nil, ErrInvalidAddress
+	}
+
+	// tunnels take the MTU from the configuration, so store the default
+	client.config.MTU, err = effectiveMTU(config.MTU)
+	if err != nil {
+		return nil, err
+	}
+
+	client.cookieGenerator.init(client.peerPublicKey, client.now)
+	return client, nil
+}
+
+// Dial performs a handshake with the peer within the configured timeout.
+func (c *Client) Dial() (*Tunnel, error) {
+	return c.dial(c.timeoutDeadline())
+}
+
+func (c *Client) dial(deadline time.Time) (*Tunnel, error) {
+	keypair, conn, err := c.handshake(deadline)
+	if err != nil {
+		return nil, err
+	}
+
+	return newTunnel(c.config, c, keypair, conn), nil
+}
+
+// timeoutDeadline is the configured timeout from now, zero without one.
+func (c *Client) timeoutDeadline() time.Time {
+	if c.config.Timeout > 0 {
+		return time.Now().Add(c.config.Timeout)
+	}
+	return time.Time{}
+}
+
+// Resume rebuilds a tunnel from a saved state without a handshake. The caller
+// must make sure that no counter from state.SendNonce on was used before.
+// Messages from the peer below state.ReceiveNonce are rejected as replays, so
+// the state should be saved again after receiving.
+func (c *Client) Resume(state SessionState) (*Tunnel, error) {
+	if c.now().Sub(state.Created) >= RejectAfterTime {
+		return nil, ErrSessionExpired
+	}
+
+	remoteAddress, err := net.ResolveUDPAddr("udp4", c.config.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	var localAddress *net.UDPAddr
+	if state.LocalAddress != "" {
+		localAddress, err = net.ResolveUDPAddr("udp4", state.LocalAddress)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	conn, err := net.DialUDP("udp4", localAddress, remoteAddress)
+	if err != nil {
+		return nil, err
+	}
+
+	keypair := newKeypair(state.SendKey, state.ReceiveKey)
+	keypair.sendNonce = state.SendNonce
+	keypair.receiveNonce = state.ReceiveNonce
+	keypair.replay.seed(state.ReceiveNonce)
+	keypair.created = state.Created
+	keypair.isInitiator = true
+	keypair.localIndex = state.LocalIndex
+	keypair.remoteIndex = state.RemoteIndex
+
+	return newTunnel(c.config, c, keypair, conn), nil
+}
+
+// Exchange sends payload and waits until deadline for the reply, a zero
+// deadline meaning no limit. Concurrent calls share one tunnel, dialed on first
+// use, and each gets a source port of its own so that replies reach the right
+// caller. After the tunnel fails, on a socket error or an expired session, the
+// next call dials a new one. The deadline also ends the handshake a call starts
+// and its wait for one in progress; the configured timeout plays no part.
+func (c *Client) Exchange(payload []byte, destinationIpAddress string, destinationPort int, deadline time.Time) ([]byte, error) {
+	return c.ExchangeWithOptions(payload, destinationIpAddress, destinationPort, deadline, PacketOptions{})
+}
+
+// ExchangeWithOptions is Exchange with the given header fields.
+func (c *Client) ExchangeWithOptions(payload []byte, destinationIpAddress string, destinationPort int, deadline time.Time, options PacketOptions) ([]byte, error) {
+	expired := newDeadline()
+	expired.set(deadline)
+	defer expired.set(time.Time{})
+
+	return c.exchange(payload, destinationIpAddress, destinationPort, deadline, expired, options)
+}
+
+func (c *Client) exchange(payload []byte, destinationIpAddress string, destinationPort int, deadline time.Time, expired *deadline, options PacketOptions) ([]byte, error) {
+	session, err := c.acquire(deadline, expired.wait())
+	if err != nil {
+		return nil, err
+	}
+
+	response, err := session.tunnel.exchange(payload, destinationIpAddress, destinationPort, expired, options)
+	c.release(session, tunnelFailed(err))
+	return response, err
+}
+
+// ExchangeContext is ExchangeWithOptions with the deadline of ctx, ending early
+// with the error of ctx when it is canceled.
+func (c *Client) ExchangeContext(ctx context.Context, payload []byte, destinationIpAddress string, destinationPort int, options PacketOptions) ([]byte, error) {
+	// ctx is done at its deadline as well, so that its error is set whenever
+	// the call stops early
+	deadline, _ := ctx.Deadline()
+	expired := newDeadline()
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			// as package net does, a deadline in the past stops the call
+			expired.set(time.Unix(1, 0))
+		case <-stop:
+		}
+	}()
+
+	response, err := c.exchange(payload, destinationIpAddress, destinationPort, deadline, expired, options)
+	if errors.Is(err, os.ErrDeadlineExceeded) && ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	return response, err
+}
+
+// tunnelFailed reports whether err is down to the tunnel rather than the
+// request. A request timing out says nothing about the tunnel, as replies are
+// routed by source port.
+func tunnelFailed(err error) bool {
+	var opErr *net.OpError
+	return errors.Is(err, ErrDecryptFailed) || errors.Is(err, ErrSessionExpired) || errors.Is(err, net.ErrClosed) || errors.As(err, &opErr)
+}
+
+// ListenPacket is Tunnel.ListenPacket on the tunnel shared by Exchange. The
+// tunnel stays open until every connection on it is closed; after it fails, as
+// for Exchange, connections opened later get a new one. Dialing it takes at
+// most the configured timeout.
+func (c *Client) ListenPacket(port int) (net.PacketConn, error) {
+	session, err := c.acquire(c.timeoutDeadline(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := session.tunnel.ListenPacket(port)
+	if err != nil {
+		c.release(session, false)
+		return nil, err
+	}
+	return &clientPacketConn{PacketConn: conn, client: c, session: session}, nil
+}
+
+// clientPacketConn holds the shared tunnel for its connection.
+type clientPacketConn struct {
+	net.PacketConn
+	client  *Client
+	session *clientSession
+	closed  bool // guarded by the client's sessionMutex
+}
+
+func (c *clientPacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	n, address, err := c.PacketConn.ReadFrom(b)
+	c.check(err)
+	return n, address, err
+}
+
+func (c *clientPacketConn) WriteTo(b []byte, address net.Addr) (int, error) {
+	n, err := c.PacketConn.WriteTo(b, address)
+	c.check(err)
+	return n, err
+}
+
+// check retires the tunnel when err is down to it. Closing the connection
+// makes its reads fail as well, which says nothing about the tunnel.
+func (c *clientPacketConn) check(err error) {
+	if !tunnelFailed(err) {
+		return
+	}
+
+	c.client.sessionMutex.Lock()
+	defer c.client.sessionMutex.Unlock()
+	if !c.closed {
+		c.client.retire(c.session)
+	}
+}
+
+func (c *clientPacketConn) Close() error {
+	c.client.sessionMutex.Lock()
+	if c.closed {
+		c.client.sessionMutex.Unlock()
+		return net.ErrClosed
+	}
+	c.closed = true
+	c.client.sessionMutex.Unlock()
+
+	err := c.PacketConn.Close()
+	c.client.release(c.session, false)
+	return err
+}
+
+// UdpOneShot is Exchange within the configured timeout.
+func (c *Client) UdpOneShot(payload []byte, destinationIpAddress string, destinationPort int) ([]byte, error) {
+	return c.Exchange(payload, destinationIpAddress, destinationPort, c.timeoutDeadline())
+}
+
+// Close closes the tunnel shared by Exchange and ListenPacket, failing the
+// exchanges and connections on it; later calls fail with net.ErrClosed.
+// Tunnels returned by Dial and Resume are closed by their users.
+func (c *Client) Close() error {
+	c.sessionMutex.Lock()
+	defer c.sessionMutex.Unlock()
+
+	c.closed = true
+	if c.session == nil {
+		return nil
+	}
+	err := c.session.tunnel.Close()
+	c.session = nil
+	return err
+}
+
+// clientSession is the tunnel shared by Exchange. A failed one is replaced at
+// once but only closed when the last exchange on it is done.
+type clientSession struct {
+	tunnel  *Tunnel
+	users   int
+	retired bool
+}
+
+// clientDial is a handshake for the shared tunnel; done is closed when it is
+// over.
+type clientDial struct {
+	done chan struct{}
+	err  error
+}
+
+// acquire returns the shared tunnel, dialing it within deadline when there is
+// none. It stops waiting for the handshake when expired is closed.
+func (c *Client) acquire(deadline time.Time, expired <-chan struct{}) (*clientSession, error) {
+	c.sessionMutex.Lock()
+	defer c.sessionMutex.Unlock()
+
+	for c.session == nil {
+		if c.closed {
+			return nil, net.ErrClosed
+		}
+
+		// callers arriving meanwhile wait for this handshake instead of
+		// starting their own, which would replace it at the peer
+		dial := c.dialing
+		if dial == nil {
+			dial = &clientDial{done: make(chan struct{})}
+			c.dialing = dial
+			go c.dialShared(dial, deadline)
+		}
+
+		c.sessionMutex.Unlock()
+		select {
+		case <-dial.done:
+		case <-expired:
+			c.sessionMutex.Lock()
+			return nil, os.ErrDeadlineExceeded
+		}
+		c.sessionMutex.Lock()
+
+		if dial.err != nil {
+			return nil, dial.err
+		}
+	}
+
+	c.session.users++
+	return c.session, nil
+}
+
+// dialShared installs the tunnel of dial. It runs on when the callers waiting
+// for it are gone, so that the next ones find the tunnel.
+func (c *Client) dialShared(dial *clientDial, deadline time.Time) {
+	tunnel, err := c.dial(deadline)
+
+	c.sessionMutex.Lock()
+	defer c.sessionMutex.Unlock()
+
+	c.dialing = nil
+	if err == nil && c.closed {
+		// Close did not see this tunnel
+		tunnel.Close()
+		err = net.ErrClosed
+	}
+	if err == nil {
+		c.session = &clientSession{tunnel: tunnel}
+	}
+	dial.err = err
+	close(dial.done)
+}
+
+func (c *Client) release(session *clientSession, failed bool) {
+	c.sessionMutex.Lock()
+	defer c.sessionMutex.Unlock()
+
+	session.users--
+	if failed {
+		c.retire(session)
+	}
+	if session.retired && session.users == 0 {
+		session.tunnel.Close()
+	}
+}
+
+// retire makes the next caller dial a new tunnel. Called with the mutex held.
+func (c *Client) retire(session *clientSession) {
+	if c.session == session {
+		c.session = nil
+		session.retired = true
+	}
+}
+
+// paceInitiation waits until the peer accepts another initiation from us,
+// which also keeps the timestamps of our initiations increasing.
+func (c *Client) paceInitiation() {
+	c.initiationMutex.Lock()
+	defer c.initiationMutex.Unlock()
+
+	wait := time.Until(c.lastInitiation.Add(HandshakeInitiationRate))
+	if wait > 0 {
+		time.Sleep(wait)
+	}
+	c.lastInitiation = time.Now()
+}
+
+// cookie copies the latest cookie into the generator of a new initiation.
+func (c *Client) cookie(generator *CookieGenerator) {
+	c.cookieMutex.Lock()
+	defer c.cookieMutex.Unlock()
+	*generator = c.cookieGenerator
+}
+
+// setCookie keeps a cookie received by one handshake for the next ones.
+func (c *Client) setCookie(generator *CookieGenerator) {
+	c.cookieMutex.Lock()
+	defer c.cookieMutex.Unlock()
+	if generator.mac2.cookieSet.After(c.cookieGenerator.mac2.cookieSet) {
+		c.cookieGenerator.mac2.cookie = generator.mac2.cookie
+		c.cookieGenerator.mac2.cookieSet = generator.mac2.cookieSet
+	}
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// Only the fields needed to tell the supported event sources apart.
+type lambdaEvent struct {
+	Records []struct {
+		EventSource string `json:"eventSource"`
+	} `json:"Records"`
+	HTTPMethod     string `json:"httpMethod"`
+	RequestContext struct {
+		HTTP *json.RawMessage `json:"http"`
+	} `json:"requestContext"`
+}
+
+// SQS partial batch response, see ReportBatchItemFailures of the event source mapping.
+type sqsBatchResponse struct {
+	BatchItemFailures []sqsBatchItemFailure `json:"batchItemFailures"`
+}
+
+type sqsBatchItemFailure struct {
+	ItemIdentifier string `json:"itemIdentifier"`
+}
+
+type invokeResponse struct {
+	Payload string `json:"payload"`
+}
+
+func handler(ctx context.Context, raw json.RawMessage) (interface{}, error) {
+	var event lambdaEvent
+	err := json.Unmarshal(raw, &event)
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case len(event.Records) > 0 && event.Records[0].EventSource == "aws:sqs":
+		var request events.SQSEvent
+		err = json.Unmarshal(raw, &request)
+		if err != nil {
+			return nil, err
+		}
+		return handleSQS(ctx, request)
+	case event.RequestContext.HTTP != nil:
+		// API Gateway HTTP API (payload format 2.0) and Lambda Function URLs
+		var request events.APIGatewayV2HTTPRequest
+		err = json.Unmarshal(raw, &request)
+		if err != nil {
+			return nil, err
+		}
+		return handleAPIGatewayV2(ctx, request)
+	case event.HTTPMethod != "":
+		var request events.APIGatewayProxyRequest
+		err = json.Unmarshal(raw, &request)
+		if err != nil {
+			return nil, err
+		}
+		return handleAPIGateway(ctx, request)
+	default:
+		return handleInvoke(ctx, raw)
+	}
+}
+
+func handleAPIGateway(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	body := request.Body
+	var bodyDecoded []byte
+	if request.IsBase64Encoded {
+		bodyDecoded, _ = base64.StdEncoding.DecodeString(body)
+	} else {
+		bodyDecoded = []byte(body)
+	}
+
+	receivedBuffer, err := process(ctx, bodyDecoded, lambdaTimeout(ctx))
+	if err != nil {
+		return events.APIGatewayProxyResponse{
+			Body:       string(err.Error()),
+			StatusCode: 400,
+		}, err
+	}
+
+	return events.APIGatewayProxyResponse{
+		Body:       string(receivedBuffer),
+		StatusCode: 200,
+	}, nil
+}
+
+func handleAPIGatewayV2(ctx context.Context, request events.APIGatewayV2HTTPRequest) (events.APIGatewayV2HTTPResponse, error) {
+	body := request.Body
+	var bodyDecoded []byte
+	if request.IsBase64Encoded {
+		bodyDecoded, _ = base64.StdEncoding.DecodeString(body)
+	} else {
+		bodyDecoded = []byte(body)
+	}
+
+	receivedBuffer, err := process(ctx, bodyDecoded, lambdaTimeout(ctx))
+	if err != nil {
+		// an error would make Lambda answer 502 and drop this response
+		return events.APIGatewayV2HTTPResponse{
+			Body:       string(err.Error()),
+			StatusCode: 400,
+		}, nil
+	}
+
+	return events.APIGatewayV2HTTPResponse{
+		Body:       string(receivedBuffer),
+		StatusCode: 200,
+	}, nil
+}
+
+// Each message body is an ArcGateway request. Failed messages are reported
+// individually so that only they return to the queue.
+func handleSQS(ctx context.Context, request events.SQSEvent) (sqsBatchResponse, error) {
+	response := sqsBatchResponse{
+		BatchItemFailures: []sqsBatchItemFailure{},
+	}
+
+	for _, message := range request.Records {
+		_, err := process(ctx, []byte(message.Body), lambdaTimeout(ctx))
+		if err != nil {
+			response.BatchItemFailures = append(response.BatchItemFailures, sqsBatchItemFailure{
+				ItemIdentifier: message.MessageId,
+			})
+		}
+	}
+
+	return response, nil
+}
+
+func handleInvoke(ctx context.Context, raw json.RawMessage) (invokeResponse, error) {
+	receivedBuffer, err := process(ctx, raw, lambdaTimeout(ctx))
+	if err != nil {
+		return invokeResponse{}, err
+	}
+
+	return invokeResponse{
+		Payload: string(receivedBuffer),
+	}, nil
+}
+
+// A stale cached session costs one timeout before the retry on a fresh
+// handshake, so each attempt gets at most half of the remaining invocation time.
+func lambdaTimeout(ctx context.Context) time.Duration {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return timeout
+	}
+
+	remaining := time.Until(deadline) / 2
+	if remaining < timeout {
+		return remaining
+	}
+	return timeout
+}
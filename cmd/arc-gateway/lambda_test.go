@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/1stship/wireguard-oneshot"
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// stubExchange echoes the payload, failing for "fail".
+func stubExchange(t *testing.T) {
+	t.Helper()
+	exchange = func(ctx context.Context, config wireguard.Configuration, payload []byte, destinationIpAddress string, destinationPort int) ([]byte, error) {
+		if string(payload) == "fail" {
+			return nil, errors.New("exchange failed")
+		}
+		return payload, nil
+	}
+	t.Cleanup(func() { exchange = cachedExchange })
+}
+
+func TestHandler(t *testing.T) {
+	stubExchange(t)
+
+	const (
+		hello = `{\"destinationIpAddress\":\"10.0.0.1\",\"destinationPort\":7,\"payload\":\"hello\"}`
+		fail  = `{\"destinationIpAddress\":\"10.0.0.1\",\"destinationPort\":7,\"payload\":\"fail\"}`
+	)
+
+	tests := []struct {
+		name  string
+		event string
+		want  interface{}
+	}{
+		{
+			"API Gateway REST API",
+			`{"resource":"/","path":"/","httpMethod":"POST","requestContext":{"stage":"prod"},"body":"` + hello + `","isBase64Encoded":false}`,
+			events.APIGatewayProxyResponse{StatusCode: 200, Body: "hello"},
+		},
+		{
+			"API Gateway HTTP API",
+			`{"version":"2.0","routeKey":"POST /","rawPath":"/","requestContext":{"apiId":"api","http":{"method":"POST","path":"/"}},"body":"` + hello + `","isBase64Encoded":false}`,
+			events.APIGatewayV2HTTPResponse{StatusCode: 200, Body: "hello"},
+		},
+		{
+			"API Gateway HTTP API error",
+			`{"version":"2.0","routeKey":"POST /","rawPath":"/","requestContext":{"apiId":"api","http":{"method":"POST","path":"/"}},"body":"` + fail + `","isBase64Encoded":false}`,
+			events.APIGatewayV2HTTPResponse{StatusCode: 400, Body: "exchange failed"},
+		},
+		{
+			"function URL",
+			`{"version":"2.0","routeKey":"$default","rawPath":"/","requestContext":{"domainName":"abc.lambda-url.ap-northeast-1.on.aws","http":{"method":"POST","path":"/"}},"body":"eyJkZXN0aW5hdGlvbklwQWRkcmVzcyI6IjEwLjAuMC4xIiwiZGVzdGluYXRpb25Qb3J0Ijo3LCJwYXlsb2FkIjoiaGVsbG8ifQ==","isBase64Encoded":true}`,
+			events.APIGatewayV2HTTPResponse{StatusCode: 200, Body: "hello"},
+		},
+		{
+			"SQS",
+			`{"Records":[{"messageId":"m1","eventSource":"aws:sqs","body":"` + hello + `"},{"messageId":"m2","eventSource":"aws:sqs","body":"` + fail + `"}]}`,
+			sqsBatchResponse{BatchItemFailures: []sqsBatchItemFailure{{ItemIdentifier: "m2"}}},
+		},
+		{
+			"direct invoke",
+			`{"destinationIpAddress":"10.0.0.1","destinationPort":7,"payload":"hello"}`,
+			invokeResponse{Payload: "hello"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			defer cancel()
+
+			got, err := handler(ctx, json.RawMessage(test.event))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got %#v, want %#v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestHandlerInvokeError(t *testing.T) {
+	stubExchange(t)
+
+	_, err := handler(context.Background(), json.RawMessage(`{"destinationIpAddress":"10.0.0.1","destinationPort":7,"payload":"fail"}`))
+	if err == nil {
+		t.Error("direct invoke did not report the failure")
+	}
+}
@@ -1,15 +1,20 @@
 package main
 
 import (
-	"encoding/base64"
+	"context"
 	"encoding/json"
+	"flag"
+	"fmt"
+	"time"
 
 	"github.com/1stship/wireguard-oneshot"
-	"github.com/aws/aws-lambda-go/events"
+	"github.com/1stship/wireguard-oneshot/internal/format"
+	"github.com/1stship/wireguard-oneshot/internal/profile"
 	"github.com/aws/aws-lambda-go/lambda"
 )
 
 type ArcGateway struct {
+	Profile              string `json:"profile"`
     PrivateKey           string `json:"privateKey"`
     PublicKey            string `json:"publicKey"`
     Endpoint             string `json:"endpoint"`
@@ -18,28 +23,41 @@ type ArcGateway struct {
 	DestinationPort      int    `json:"destinationPort"`
 	Payload              string `json:"payload"`
 	PayloadFormat        string `json:"payloadFormat"`
+	ResponseFormat       string `json:"responseFormat"`
 }
 
+var timeout time.Duration
+
 func main() {
+	var listen string
+	var maxRequestSize int64
+	var shutdownTimeout time.Duration
+	flag.StringVar(&listen, "listen", "", "HTTPサーバーとして起動する場合の待ち受けアドレス(未指定の場合はLambdaとして起動)")
+	flag.DurationVar(&timeout, "timeout", 10 * time.Second, "リクエスト毎のタイムアウト")
+	flag.Int64Var(&maxRequestSize, "maxRequestSize", 64 * 1024, "リクエストボディの最大サイズ(バイト)")
+	flag.DurationVar(&shutdownTimeout, "shutdownTimeout", 30 * time.Second, "終了時に処理中のリクエストを待つ時間")
+	flag.Parse()
+
+	if listen != "" {
+		serve(listen, timeout, maxRequestSize, shutdownTimeout)
+		return
+	}
+
 	lambda.Start(handler)
 }
 
-func handler(request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
-	body := request.Body
-	var bodyDecoded []byte
-	if request.IsBase64Encoded {
-		bodyDecoded, _ = base64.StdEncoding.DecodeString(body)
-	} else {
-		bodyDecoded = []byte(body)
-	}
-	
+func process(ctx context.Context, body []byte, timeout time.Duration) ([]byte, error) {
 	var input ArcGateway
-	err := json.Unmarshal(bodyDecoded, &input)
+	err := json.Unmarshal(body, &input)
 	if err != nil {
-		return events.APIGatewayProxyResponse{
-			Body:       string(err.Error()),
-			StatusCode: 400,
-		}, err
+		return nil, err
+	}
+
+	if input.Profile != "" {
+		err = applyProfile(&input)
+		if err != nil {
+			return nil, err
+		}
 	}
 
 	config := wireguard.Configuration {
@@ -47,38 +65,64 @@ func handler(request events.APIGatewayProxyRequest) (events.APIGatewayProxyRespo
 		PublicKey: input.PublicKey,
 		Endpoint: input.Endpoint,
 		ClientIpAddress: input.ClientIpAddress,
+		Timeout: timeout,
+	}
+
+	if !format.Valid(input.ResponseFormat) {
+		return nil, fmt.Errorf("unknown response format %q", input.ResponseFormat)
 	}
 
-	var payload []byte
-	if input.PayloadFormat == "base64" {
-		payload, err = base64.StdEncoding.DecodeString(input.Payload)
-	    if err != nil {
-		    return events.APIGatewayProxyResponse{
-				Body:       string(err.Error()),
-				StatusCode: 400,
-			}, err
-	    }
-	} else {
-		payload = []byte(input.Payload)
+	payload, err := format.Decode(input.PayloadFormat, input.Payload)
+	if err != nil {
+		return nil, err
 	}
 
-	receivedBuffer, err := wireguard.UdpOneShot(payload, input.DestinationIpAddress, input.DestinationPort, config)
+	receivedBuffer, err := exchange(ctx, config, payload, input.DestinationIpAddress, input.DestinationPort)
 	if err != nil {
-		return events.APIGatewayProxyResponse{
-			Body:       string(err.Error()),
-			StatusCode: 400,
-		}, err
+		return nil, err
 	}
 
-	for i := 0; i < len(receivedBuffer); i++ {
-		if (receivedBuffer[i] == 0) {
-			receivedBuffer = receivedBuffer[0:i]
-			break
+	if input.ResponseFormat == "" || input.ResponseFormat == format.Text {
+		// text responses stop at the first NUL as they always have
+		for i := 0; i < len(receivedBuffer); i++ {
+			if (receivedBuffer[i] == 0) {
+				receivedBuffer = receivedBuffer[0:i]
+				break
+			}
 		}
 	}
 
-	return events.APIGatewayProxyResponse{
-        Body:       string(receivedBuffer),
-        StatusCode: 200,
-    }, nil
+	response, err := format.Encode(input.ResponseFormat, receivedBuffer)
+	if err != nil {
+		return nil, err
+	}
+
+	return []byte(response), nil
+}
+
+// The connection comes from the profile alone: a caller naming a profile must
+// not point its stored private key at another peer or endpoint.
+func applyProfile(input *ArcGateway) error {
+	fields := []struct{ name, value string }{
+		{"privateKey", input.PrivateKey},
+		{"publicKey", input.PublicKey},
+		{"endpoint", input.Endpoint},
+		{"clientIpAddress", input.ClientIpAddress},
+	}
+	for _, field := range fields {
+		if field.value != "" {
+			return fmt.Errorf("%s must not be given with a profile", field.name)
+		}
+	}
+
+	p, err := profile.Lookup(input.Profile)
+	if err != nil {
+		return err
+	}
+
+	input.PrivateKey = p.PrivateKey
+	input.PublicKey = p.PublicKey
+	input.Endpoint = p.Endpoint
+	input.ClientIpAddress = p.ClientIpAddress
+	return nil
 }
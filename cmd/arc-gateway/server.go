@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// the error of http.MaxBytesReader, which has no type of its own before Go 1.19
+const errRequestTooLarge = "http: request body too large"
+
+func serve(listen string, timeout time.Duration, maxRequestSize int64, shutdownTimeout time.Duration) {
+	server := &http.Server{
+		Addr:              listen,
+		Handler:           newServeMux(timeout, maxRequestSize),
+		ReadHeaderTimeout: timeout,
+		ReadTimeout:       timeout,
+		// reading the body and both attempts of a stale session may each take
+		// up to timeout
+		WriteTimeout: 3 * timeout,
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	errs := make(chan error, 1)
+	go func() {
+		log.Printf("arc-gateway listening on %s", listen)
+		errs <- server.ListenAndServe()
+	}()
+
+	select {
+	case err := <-errs:
+		log.Fatal(err)
+	case <-ctx.Done():
+	}
+
+	log.Println("shutting down")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	err := server.Shutdown(shutdownCtx)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func newServeMux(timeout time.Duration, maxRequestSize int64) *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxRequestSize))
+		if err != nil && err.Error() == errRequestTooLarge {
+			http.Error(w, "request body too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		if err != nil {
+			// most likely the client has gone away
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		receivedBuffer, err := process(r.Context(), body, timeout)
+		if err != nil {
+			if isTimeout(err) {
+				http.Error(w, err.Error(), http.StatusGatewayTimeout)
+				return
+			}
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Write(receivedBuffer)
+	})
+	return mux
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/1stship/wireguard-oneshot"
+	"github.com/1stship/wireguard-oneshot/wgtest"
+)
+
+func TestServer(t *testing.T) {
+	peer := wgtest.NewServer(func(datagram *wireguard.Datagram) []byte {
+		if string(datagram.Payload) == "ignored" {
+			return nil
+		}
+		return datagram.Payload
+	})
+	defer peer.Close()
+
+	request := func(payload string) string {
+		body, err := json.Marshal(ArcGateway{
+			PrivateKey:           peer.ClientPrivateKey,
+			PublicKey:            peer.PublicKey,
+			Endpoint:             peer.Endpoint,
+			ClientIpAddress:      wgtest.ClientIpAddress,
+			DestinationIpAddress: wgtest.IpAddress,
+			DestinationPort:      7,
+			Payload:              payload,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(body)
+	}
+
+	server := httptest.NewServer(newServeMux(200*time.Millisecond, 1024))
+	defer server.Close()
+
+	tests := []struct {
+		name   string
+		method string
+		body   string
+		status int
+		want   string
+	}{
+		{"exchange", http.MethodPost, request("hello"), http.StatusOK, "hello"},
+		{"method", http.MethodGet, "", http.StatusMethodNotAllowed, ""},
+		{"too large", http.MethodPost, request(strings.Repeat("a", 1024)), http.StatusRequestEntityTooLarge, ""},
+		{"malformed", http.MethodPost, "{", http.StatusBadRequest, ""},
+		{"timeout", http.MethodPost, request("ignored"), http.StatusGatewayTimeout, ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req, err := http.NewRequest(test.method, server.URL, strings.NewReader(test.body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			body, err := ioutil.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if resp.StatusCode != test.status {
+				t.Errorf("status %d, want %d: %s", resp.StatusCode, test.status, body)
+			}
+			if test.want != "" && string(body) != test.want {
+				t.Errorf("body %q, want %q", body, test.want)
+			}
+			if test.status == http.StatusMethodNotAllowed && resp.Header.Get("Allow") != http.MethodPost {
+				t.Errorf("Allow %q, want POST", resp.Header.Get("Allow"))
+			}
+		})
+	}
+}
+
+// The exchange ends when the client goes away, not at the timeout.
+func TestServerClientGone(t *testing.T) {
+	peer := wgtest.NewServer(func(datagram *wireguard.Datagram) []byte { return nil })
+	defer peer.Close()
+
+	body, err := json.Marshal(ArcGateway{
+		PrivateKey:           peer.ClientPrivateKey,
+		PublicKey:            peer.PublicKey,
+		Endpoint:             peer.Endpoint,
+		ClientIpAddress:      wgtest.ClientIpAddress,
+		DestinationIpAddress: wgtest.IpAddress,
+		DestinationPort:      7,
+		Payload:              "ignored",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+	req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(string(body))).WithContext(ctx)
+
+	start := time.Now()
+	newServeMux(time.Minute, 1024).ServeHTTP(httptest.NewRecorder(), req)
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("request took %v after the client went away", elapsed)
+	}
+}
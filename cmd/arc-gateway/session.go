@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/1stship/wireguard-oneshot"
+)
+
+// Established sessions survive between invocations of a warm Lambda container
+// (and between requests in server mode). Requests with the same keys share one
+// Client.
+var sessions = struct {
+	sync.Mutex
+	clients map[sessionKey]*sessionClient
+}{
+	clients: make(map[sessionKey]*sessionClient),
+}
+
+type sessionKey struct {
+	privateKeyHash  [sha256.Size]byte
+	publicKey       string
+	endpoint        string
+	clientIpAddress string
+}
+
+type sessionClient struct {
+	client   *wireguard.Client
+	users    int
+	lastUsed time.Time
+	retired  bool // replaced after failing, closed when the last user is done
+}
+
+func newSessionKey(config wireguard.Configuration) sessionKey {
+	return sessionKey{
+		privateKeyHash:  sha256.Sum256([]byte(config.PrivateKey)),
+		publicKey:       config.PublicKey,
+		endpoint:        config.Endpoint,
+		clientIpAddress: config.ClientIpAddress,
+	}
+}
+
+// exchange is cachedExchange, replaced in tests.
+var exchange = cachedExchange
+
+// cachedExchange stops when ctx is done, e.g. when the HTTP client has gone away.
+func cachedExchange(ctx context.Context, config wireguard.Configuration, payload []byte, destinationIpAddress string, destinationPort int) ([]byte, error) {
+	key := newSessionKey(config)
+
+	session, cached, err := acquireSession(key, config)
+	if err != nil {
+		return nil, err
+	}
+	response, err := sessionExchange(ctx, session, config.Timeout, payload, destinationIpAddress, destinationPort)
+	releaseSession(session)
+	if !cached || !isTimeout(err) || ctx.Err() != nil {
+		return response, err
+	}
+
+	// The peer may have lost the session, e.g. by restarting, and drops what
+	// we send on it until we handshake again. Try once more on a new Client
+	// rather than waiting for the tunnel to notice.
+	session, err = renewSession(key, session, config)
+	if err != nil {
+		return nil, err
+	}
+	response, err = sessionExchange(ctx, session, config.Timeout, payload, destinationIpAddress, destinationPort)
+	releaseSession(session)
+	return response, err
+}
+
+func sessionExchange(ctx context.Context, session *sessionClient, timeout time.Duration, payload []byte, destinationIpAddress string, destinationPort int) ([]byte, error) {
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	return session.client.ExchangeContext(ctx, payload, destinationIpAddress, destinationPort, wireguard.PacketOptions{})
+}
+
+// acquireSession returns the Client for key and whether it was there before.
+func acquireSession(key sessionKey, config wireguard.Configuration) (*sessionClient, bool, error) {
+	sessions.Lock()
+	defer sessions.Unlock()
+
+	// a session idle for REJECT_AFTER_TIME has expired anyway
+	for k, session := range sessions.clients {
+		if session.users == 0 && time.Since(session.lastUsed) >= wireguard.RejectAfterTime {
+			session.client.Close()
+			delete(sessions.clients, k)
+		}
+	}
+
+	session, ok := sessions.clients[key]
+	if !ok {
+		var err error
+		session, err = newSessionClient(key, config)
+		if err != nil {
+			return nil, false, err
+		}
+	}
+
+	session.users++
+	session.lastUsed = time.Now()
+	return session, ok, nil
+}
+
+// renewSession replaces stale with a new Client, unless another request has
+// done so already, and returns the one to use.
+func renewSession(key sessionKey, stale *sessionClient, config wireguard.Configuration) (*sessionClient, error) {
+	sessions.Lock()
+	defer sessions.Unlock()
+
+	session, ok := sessions.clients[key]
+	if !ok || session == stale {
+		stale.retired = true
+		if stale.users == 0 {
+			stale.client.Close()
+		}
+
+		var err error
+		session, err = newSessionClient(key, config)
+		if err != nil {
+			delete(sessions.clients, key)
+			return nil, err
+		}
+	}
+
+	session.users++
+	session.lastUsed = time.Now()
+	return session, nil
+}
+
+// newSessionClient caches a new Client for key. Called with the lock held.
+func newSessionClient(key sessionKey, config wireguard.Configuration) (*sessionClient, error) {
+	client, err := wireguard.NewClient(config)
+	if err != nil {
+		return nil, err
+	}
+	session := &sessionClient{client: client}
+	sessions.clients[key] = session
+	return session, nil
+}
+
+func releaseSession(session *sessionClient) {
+	sessions.Lock()
+	defer sessions.Unlock()
+
+	session.users--
+	session.lastUsed = time.Now()
+	if session.retired && session.users == 0 {
+		session.client.Close()
+	}
+}
+
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/1stship/wireguard-oneshot"
+	"github.com/1stship/wireguard-oneshot/wgtest"
+)
+
+// listenEcho starts a peer answering every datagram with its payload.
+func listenEcho(t *testing.T, privateKey, clientPublicKey, address string) *wireguard.Listener {
+	t.Helper()
+	listener, err := wireguard.Listen(wireguard.ListenerConfiguration{
+		PrivateKey:    privateKey,
+		ListenAddress: address,
+		IpAddress:     wgtest.IpAddress,
+		Peers:         []string{clientPublicKey},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		for {
+			tunnel, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				for {
+					datagram, err := tunnel.Receive()
+					if errors.Is(err, net.ErrClosed) {
+						return
+					}
+					if err == nil {
+						tunnel.Reply(datagram, datagram.Payload)
+					}
+				}
+			}()
+		}
+	}()
+	return listener
+}
+
+// A peer that restarted drops the cached session; the request is sent again
+// on a fresh handshake within its own timeout.
+func TestExchangeAfterPeerRestart(t *testing.T) {
+	privateKey, publicKey, err := wgtest.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientPrivateKey, clientPublicKey, err := wgtest.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	listener := listenEcho(t, privateKey, clientPublicKey, "127.0.0.1:0")
+	config := wireguard.Configuration{
+		PrivateKey:      clientPrivateKey,
+		PublicKey:       publicKey,
+		Endpoint:        listener.Addr().String(),
+		ClientIpAddress: wgtest.ClientIpAddress,
+		Timeout:         time.Second,
+	}
+
+	response, err := cachedExchange(context.Background(), config, []byte("first"), wgtest.IpAddress, 7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(response) != "first" {
+		t.Fatalf("response = %q, want first", response)
+	}
+
+	listener.Close()
+	listener = listenEcho(t, privateKey, clientPublicKey, listener.Addr().String())
+	defer listener.Close()
+
+	start := time.Now()
+	response, err = cachedExchange(context.Background(), config, []byte("second"), wgtest.IpAddress, 7)
+	if err != nil {
+		t.Fatalf("exchange after the peer restarted: %v", err)
+	}
+	if string(response) != "second" {
+		t.Errorf("response = %q, want second", response)
+	}
+	if elapsed := time.Since(start); elapsed > 2*config.Timeout+time.Second {
+		t.Errorf("exchange took %v", elapsed)
+	}
+}
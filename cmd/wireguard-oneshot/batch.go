@@ -0,0 +1,224 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/1stship/wireguard-oneshot"
+	"github.com/1stship/wireguard-oneshot/internal/format"
+)
+
+const batchMaxLineSize = 1024 * 1024
+
+type batchItem struct {
+	DestinationIpAddress string `json:"destinationIpAddress"`
+	DestinationPort      int    `json:"destinationPort"`
+	Payload              string `json:"payload"`
+	PayloadFormat        string `json:"payloadFormat"`
+}
+
+type batchResult struct {
+	Index                int    `json:"index"`
+	DestinationIpAddress string `json:"destinationIpAddress"`
+	DestinationPort      int    `json:"destinationPort"`
+	Response             string `json:"response,omitempty"`
+	ResponseFormat       string `json:"responseFormat,omitempty"`
+	Error                string `json:"error,omitempty"`
+	ErrorClass           string `json:"errorClass,omitempty"`
+}
+
+func batchCommand(args []string) {
+	var o options
+	var input string
+	var concurrency int
+	var responseFormat string
+	flagSet := flag.NewFlagSet("batch", flag.ExitOnError)
+	o.bindConnection(flagSet)
+	o.bindPacket(flagSet)
+	flagSet.StringVar(&input, "input", "-", "JSON Linesの入力ファイル(-で標準入力)")
+	flagSet.IntVar(&concurrency, "concurrency", 1, "同時に処理する数")
+	flagSet.StringVar(&responseFormat, "responseFormat", format.Base64, "応答の形式("+formatList+")")
+	flagSet.Parse(args)
+
+	err := o.resolve(flagSet)
+	if err != nil {
+		fail(exitConfig, err)
+	}
+
+	valid := o.validateConnection()
+	valid = o.validatePacket() && valid
+
+	if !valid {
+		flagSet.PrintDefaults()
+		fail(exitConfig, "Required arguments are missing.")
+	}
+
+	if concurrency < 1 {
+		fail(exitConfig, "Concurrency must be at least 1.")
+	}
+
+	// concurrent items would contend for the port
+	if o.sourcePort != 0 && concurrency > 1 {
+		fail(exitConfig, "Source port must not be combined with concurrency above 1.")
+	}
+
+	if !format.Valid(responseFormat) {
+		fail(exitConfig, fmt.Sprintf("Unknown response format %q.", responseFormat))
+	}
+
+	reader := os.Stdin
+	if input != "-" {
+		reader, err = os.Open(input)
+		if err != nil {
+			fail(exitConfig, err)
+		}
+		defer reader.Close()
+	}
+
+	config := wireguard.Configuration{
+		PrivateKey:      o.privateKey,
+		PublicKey:       o.publicKey,
+		Endpoint:        o.endpoint,
+		ClientIpAddress: o.clientIpAddress,
+		Timeout:         o.timeout,
+		MTU:             o.mtu,
+	}
+
+	tunnel, err := wireguard.Dial(config)
+	if err != nil {
+		fail(handshakeExitCode(err), err)
+	}
+
+	results := make(chan batchResult, concurrency)
+	done := make(chan bool)
+	go func() {
+		done <- writeBatchResults(results)
+	}()
+
+	err = runBatch(reader, concurrency, func(index int, item batchItem) batchResult {
+		return exchangeBatchItem(tunnel, index, item, o.timeout, o.maxPayloadSize(), o.packetOptions(), responseFormat)
+	}, results)
+	close(results)
+	succeeded := <-done
+	tunnel.Close()
+
+	if err != nil {
+		fail(exitFailure, err)
+	}
+	if !succeeded {
+		os.Exit(exitFailure)
+	}
+}
+
+func runBatch(reader io.Reader, concurrency int, process func(int, batchItem) batchResult, results chan<- batchResult) error {
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(make([]byte, 64*1024), batchMaxLineSize)
+
+	var wg sync.WaitGroup
+	semaphore := make(chan struct{}, concurrency)
+	index := 0
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		if len(line) == 0 {
+			continue
+		}
+
+		var item batchItem
+		err := json.Unmarshal(line, &item)
+		if err != nil {
+			results <- batchResult{
+				Index:      index,
+				Error:      err.Error(),
+				ErrorClass: errorClasses[exitConfig],
+			}
+			index++
+			continue
+		}
+
+		semaphore <- struct{}{}
+		wg.Add(1)
+		go func(index int, item batchItem) {
+			defer wg.Done()
+			results <- process(index, item)
+			<-semaphore
+		}(index, item)
+		index++
+	}
+
+	wg.Wait()
+	return scanner.Err()
+}
+
+// writeBatchResults prints results in input order as soon as they are
+// available and reports whether every item succeeded.
+func writeBatchResults(results <-chan batchResult) bool {
+	succeeded := true
+	pending := make(map[int]batchResult)
+	next := 0
+	for result := range results {
+		pending[result.Index] = result
+		for {
+			r, ok := pending[next]
+			if !ok {
+				break
+			}
+			delete(pending, next)
+			if r.Error != "" {
+				succeeded = false
+			}
+			printJSON(r)
+			next++
+		}
+	}
+	return succeeded
+}
+
+// exchangeBatchItem sends an item on the tunnel shared by all items. Each
+// exchange has a source port of its own, so concurrent items may go to the
+// same destination.
+func exchangeBatchItem(tunnel *wireguard.Tunnel, index int, item batchItem, timeout time.Duration, maxPayloadSize int, packet wireguard.PacketOptions, responseFormat string) batchResult {
+	result := batchResult{
+		Index:                index,
+		DestinationIpAddress: item.DestinationIpAddress,
+		DestinationPort:      item.DestinationPort,
+	}
+
+	failed := func(code int, err error) batchResult {
+		result.Error = err.Error()
+		result.ErrorClass = errorClasses[code]
+		return result
+	}
+
+	if net.ParseIP(item.DestinationIpAddress) == nil || item.DestinationPort <= 0 || item.DestinationPort > 65535 {
+		return failed(exitConfig, errors.New("invalid destination"))
+	}
+
+	payload, err := format.Decode(item.PayloadFormat, item.Payload)
+	if err != nil {
+		return failed(exitConfig, err)
+	}
+	if len(payload) > maxPayloadSize {
+		return failed(exitConfig, fmt.Errorf("payload must not exceed %d bytes", maxPayloadSize))
+	}
+
+	receivedBuffer, err := tunnel.ExchangeWithOptions(payload, item.DestinationIpAddress, item.DestinationPort, deadline(timeout), packet)
+	if err != nil {
+		return failed(exchangeExitCode(err), err)
+	}
+
+	response, err := format.Encode(responseFormat, receivedBuffer)
+	if err != nil {
+		return failed(exitFailure, err)
+	}
+	result.Response = response
+	result.ResponseFormat = responseFormat
+	return result
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/1stship/wireguard-oneshot"
+)
+
+type options struct {
+	profileName          string
+	privateKey           string
+	publicKey            string
+	endpoint             string
+	clientIpAddress      string
+	timeout              time.Duration
+	mtu                  int
+	destinationIpAddress string
+	destinationPort      int
+	sourcePort           int
+	ttl                  int
+	dscp                 int
+	allowFragmentation   bool
+
+	sources map[string]string // flag name -> where its value came from
+}
+
+// Environment variables for flags not given on the command line.
+var environmentVariables = map[string]string{
+	"profile":              "WG_PROFILE",
+	"privateKey":           "WG_PRIVATE_KEY",
+	"publicKey":            "WG_PEER_PUBLIC_KEY",
+	"endpoint":             "WG_ENDPOINT",
+	"clientIpAddress":      "WG_CLIENT_ADDRESS",
+	"timeout":              "WG_TIMEOUT",
+	"mtu":                  "WG_MTU",
+	"destinationIpAddress": "WG_DESTINATION_ADDRESS",
+	"destinationPort":      "WG_DESTINATION_PORT",
+	"sessionCache":         "WG_SESSION_CACHE",
+	"persistentKeepalive":  "WG_PERSISTENT_KEEPALIVE",
+	"sourcePort":           "WG_SOURCE_PORT",
+	"ttl":                  "WG_TTL",
+	"dscp":                 "WG_DSCP",
+	"allowFragmentation":   "WG_ALLOW_FRAGMENTATION",
+}
+
+func (o *options) bindConnection(flagSet *flag.FlagSet) {
+	flagSet.StringVar(&o.profileName, "profile", "", "プロファイル名")
+	flagSet.StringVar(&o.privateKey, "privateKey", "", "サーバーの秘密鍵")
+	flagSet.StringVar(&o.publicKey, "publicKey", "", "サーバーの公開鍵")
+	flagSet.StringVar(&o.endpoint, "endpoint", "", "サーバーのエンドポイント")
+	flagSet.StringVar(&o.clientIpAddress, "clientIpAddress", "", "クライアントのIPアドレス")
+	flagSet.DurationVar(&o.timeout, "timeout", 10*time.Second, "ハンドシェイクと応答それぞれのタイムアウト(0で無制限)")
+	flagSet.IntVar(&o.mtu, "mtu", wireguard.DefaultMTU, "トンネル内のMTU")
+}
+
+func (o *options) bindDestination(flagSet *flag.FlagSet) {
+	flagSet.StringVar(&o.destinationIpAddress, "destinationIpAddress", "", "宛先のIPアドレス")
+	flagSet.IntVar(&o.destinationPort, "destinationPort", 0, "宛先ポート")
+}
+
+func (o *options) bindPacket(flagSet *flag.FlagSet) {
+	flagSet.IntVar(&o.sourcePort, "sourcePort", 0, "送信元ポート(0で自動)")
+	flagSet.IntVar(&o.ttl, "ttl", wireguard.DefaultTTL, "TTL(IPv6ではホップリミット)")
+	flagSet.IntVar(&o.dscp, "dscp", 0, "DSCP(0-63)")
+	flagSet.BoolVar(&o.allowFragmentation, "allowFragmentation", false, "DFビットを立てずに送信する")
+}
+
+func (o *options) packetOptions() wireguard.PacketOptions {
+	return wireguard.PacketOptions{
+		SourcePort:         o.sourcePort,
+		TTL:                o.ttl,
+		DSCP:               o.dscp,
+		AllowFragmentation: o.allowFragmentation,
+	}
+}
+
+// maxPayloadSize is the largest payload fitting in one inner IPv4 packet.
+func (o *options) maxPayloadSize() int {
+	return o.mtu - wireguard.IpHeaderSize - wireguard.UdpHeaderSize
+}
+
+// resolve fills in values not given as flags, from environment variables and
+// then from the profile.
+func (o *options) resolve(flagSet *flag.FlagSet) error {
+	o.sources = make(map[string]string)
+	flagSet.Visit(func(f *flag.Flag) {
+		o.sources[f.Name] = "flag"
+	})
+
+	var err error
+	flagSet.VisitAll(func(f *flag.Flag) {
+		name, ok := environmentVariables[f.Name]
+		if !ok || o.sources[f.Name] != "" || err != nil {
+			return
+		}
+
+		value := os.Getenv(name)
+		if value == "" {
+			return
+		}
+
+		err = flagSet.Set(f.Name, value)
+		if err != nil {
+			err = fmt.Errorf("%s: %w", name, err)
+			return
+		}
+		o.sources[f.Name] = "env " + name
+	})
+	if err != nil {
+		return err
+	}
+
+	if o.profileName == "" {
+		return nil
+	}
+
+	before := [...]string{o.privateKey, o.publicKey, o.endpoint, o.clientIpAddress}
+	err = applyProfile(o.profileName, &o.privateKey, &o.publicKey, &o.endpoint, &o.clientIpAddress)
+	if err != nil {
+		return err
+	}
+
+	after := [...]string{o.privateKey, o.publicKey, o.endpoint, o.clientIpAddress}
+	for i, name := range [...]string{"privateKey", "publicKey", "endpoint", "clientIpAddress"} {
+		if before[i] != after[i] {
+			o.sources[name] = "profile " + o.profileName
+		}
+	}
+	return nil
+}
+
+// validateConnection reports every missing value on stderr.
+func (o *options) validateConnection() bool {
+	valid := true
+
+	if o.privateKey == "" {
+		fmt.Fprintln(os.Stderr, "Private key must not be empty.")
+		valid = false
+	}
+
+	if o.publicKey == "" {
+		fmt.Fprintln(os.Stderr, "Public key must not be empty.")
+		valid = false
+	}
+
+	if o.endpoint == "" {
+		fmt.Fprintln(os.Stderr, "Endpoint must not be empty.")
+		valid = false
+	}
+
+	if o.clientIpAddress == "" {
+		fmt.Fprintln(os.Stderr, "Client IP address must not be empty.")
+		valid = false
+	}
+
+	if o.mtu < wireguard.MinMTU || o.mtu > wireguard.MaxMTU {
+		fmt.Fprintf(os.Stderr, "MTU must be between %d and %d.\n", wireguard.MinMTU, wireguard.MaxMTU)
+		valid = false
+	}
+
+	return valid
+}
+
+func (o *options) validateDestination() bool {
+	valid := true
+
+	if o.destinationIpAddress == "" {
+		fmt.Fprintln(os.Stderr, "Destination IP address must not be empty.")
+		valid = false
+	}
+
+	if o.destinationPort == 0 {
+		fmt.Fprintln(os.Stderr, "Destination Port must not be empty.")
+		valid = false
+	}
+
+	return valid
+}
+
+func (o *options) validatePacket() bool {
+	valid := true
+
+	if o.sourcePort < 0 || o.sourcePort > 65535 {
+		fmt.Fprintln(os.Stderr, "Source port must be between 0 and 65535.")
+		valid = false
+	}
+
+	if o.ttl < 1 || o.ttl > 255 {
+		fmt.Fprintln(os.Stderr, "TTL must be between 1 and 255.")
+		valid = false
+	}
+
+	if o.dscp < 0 || o.dscp > 63 {
+		fmt.Fprintln(os.Stderr, "DSCP must be between 0 and 63.")
+		valid = false
+	}
+
+	return valid
+}
+
+func configCommand(args []string) {
+	if len(args) == 0 || args[0] != "print" {
+		fail(exitConfig, "usage: wireguard-oneshot config print [flags]")
+	}
+
+	var o options
+	flagSet := flag.NewFlagSet("config print", flag.ExitOnError)
+	o.bindConnection(flagSet)
+	o.bindDestination(flagSet)
+	o.bindPacket(flagSet)
+	flagSet.Parse(args[1:])
+
+	err := o.resolve(flagSet)
+	if err != nil {
+		fail(exitConfig, err)
+	}
+
+	privateKey := ""
+	if o.privateKey != "" {
+		privateKey = "(hidden)"
+	}
+
+	rows := []struct {
+		name  string
+		value string
+	}{
+		{"profile", o.profileName},
+		{"privateKey", privateKey},
+		{"publicKey", o.publicKey},
+		{"endpoint", o.endpoint},
+		{"clientIpAddress", o.clientIpAddress},
+		{"timeout", o.timeout.String()},
+		{"mtu", fmt.Sprint(o.mtu)},
+		{"destinationIpAddress", o.destinationIpAddress},
+		{"destinationPort", fmt.Sprint(o.destinationPort)},
+		{"sourcePort", fmt.Sprint(o.sourcePort)},
+		{"ttl", fmt.Sprint(o.ttl)},
+		{"dscp", fmt.Sprint(o.dscp)},
+		{"allowFragmentation", fmt.Sprint(o.allowFragmentation)},
+	}
+
+	for _, row := range rows {
+		source := o.sources[row.name]
+		if source == "" {
+			source = "default"
+		}
+		fmt.Printf("%-21s %-46s (%s)\n", row.name+":", row.value, source)
+	}
+}
@@ -1,93 +1,232 @@
 package main
 
 import (
-	"encoding/base64"
+	"errors"
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"os"
+	"strings"
+	"time"
 
 	"github.com/1stship/wireguard-oneshot"
+	"github.com/1stship/wireguard-oneshot/internal/format"
 )
 
+var formatList = strings.Join(format.Formats, ", ")
+
 func main() {
-	var privateKey string
-	var publicKey string
-	var endpoint string
-	var clientIpAddress string
-	var destinationIpAddress string
-	var destinationPort int
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "socks5":
+			socks5Command(os.Args[2:])
+			return
+		case "profile":
+			profileCommand(os.Args[2:])
+			return
+		case "config":
+			configCommand(os.Args[2:])
+			return
+		case "batch":
+			batchCommand(os.Args[2:])
+			return
+		}
+	}
+
+	var o options
 	var payload string
+	var payloadFile string
 	var payloadFormat string
-	flag.StringVar(&privateKey, "privateKey", "", "サーバーの秘密鍵")
-	flag.StringVar(&publicKey, "publicKey", "", "サーバーの公開鍵")
-	flag.StringVar(&endpoint, "endpoint", "", "サーバーのエンドポイント")
-	flag.StringVar(&clientIpAddress, "clientIpAddress", "", "クライアントのIPアドレス")
-	flag.StringVar(&destinationIpAddress, "destinationIpAddress", "", "宛先のIPアドレス")
-	flag.IntVar(&destinationPort, "destinationPort", 0, "宛先ポート")
+	var responseFormat string
+	var sessionCache bool
+	o.bindConnection(flag.CommandLine)
+	o.bindDestination(flag.CommandLine)
+	o.bindPacket(flag.CommandLine)
 	flag.StringVar(&payload, "payload", "", "ペイロード")
-	flag.StringVar(&payloadFormat, "payloadFormat", "", "ペイロードの形式(text or base64)")
+	flag.StringVar(&payloadFile, "payloadFile", "", "ペイロードを読み込むファイル(-で標準入力)")
+	flag.StringVar(&payloadFormat, "payloadFormat", "", "ペイロードの形式(" + formatList + ")")
+	flag.StringVar(&responseFormat, "responseFormat", "", "応答の表示形式(" + formatList + ")")
+	flag.BoolVar(&sessionCache, "sessionCache", false, "確立したセッションをディスクに保存して次回以降の実行で再利用する")
+	flag.StringVar(&output, "output", outputText, "出力形式(text, hex, base64, json)")
 	flag.Parse()
 
-	var payloadBytes []byte
+	switch output {
+	case outputText, outputJSON:
+	case outputHex, outputBase64:
+		if responseFormat != "" {
+			fail(exitConfig, fmt.Sprintf("Output %s must not be combined with response format.", output))
+		}
+		responseFormat = output
+	default:
+		message := fmt.Sprintf("Unknown output %q.", output)
+		output = outputText
+		fail(exitConfig, message)
+	}
+
 	var err error
-	if payloadFormat == "base64" {
-		payloadBytes, err = base64.StdEncoding.DecodeString(payload)
-	    if err != nil {
-		    fmt.Println(err)
-			os.Exit(1)
-	    }
-	} else {
-		payloadBytes = []byte(payload)
+	if payloadFile != "" {
+		if payload != "" {
+			fail(exitConfig, "Payload and payload file must not be specified together.")
+		}
+
+		payload, err = readPayloadFile(payloadFile)
+		if err != nil {
+			fail(exitConfig, err)
+		}
 	}
 
-	valid := true
+	if !format.Valid(responseFormat) {
+		fail(exitConfig, fmt.Sprintf("Unknown response format %q.", responseFormat))
+	}
 
-	if privateKey == "" {
-		fmt.Println("Private key must not be empty.")
-		valid = false
+	payloadBytes, err := format.Decode(payloadFormat, payload)
+	if err != nil {
+		fail(exitConfig, err)
 	}
 
-	if publicKey == "" {
-		fmt.Println("Public key must not be empty.")
-		valid = false
+	err = o.resolve(flag.CommandLine)
+	if err != nil {
+		fail(exitConfig, err)
 	}
 
-	if endpoint == "" {
-		fmt.Println("Endpoint must not be empty.")
-		valid = false
+	valid := o.validateConnection()
+	valid = o.validateDestination() && valid
+	valid = o.validatePacket() && valid
+
+	if !valid {
+		flag.PrintDefaults()
+		fail(exitConfig, "Required arguments are missing.")
 	}
 
-	if clientIpAddress == "" {
-		fmt.Println("Client IP address must not be empty.")
-		valid = false
+	if len(payloadBytes) > o.maxPayloadSize() {
+		fail(exitConfig, fmt.Sprintf("Payload must not exceed %d bytes at MTU %d (got %d).", o.maxPayloadSize(), o.mtu, len(payloadBytes)))
 	}
 
-	if destinationIpAddress == "" {
-		fmt.Println("Destination IP address must not be empty.")
-		valid = false
+	config := wireguard.Configuration {
+		PrivateKey: o.privateKey,
+		PublicKey: o.publicKey,
+		Endpoint: o.endpoint,
+		ClientIpAddress: o.clientIpAddress,
+		Timeout: o.timeout,
+		MTU: o.mtu,
 	}
 
-	if destinationPort == 0 {
-		fmt.Println("Destination Port must not be empty.")
-		valid = false
+	var receivedBuffer []byte
+	if sessionCache {
+		receivedBuffer, err = exchangeCached(config, payloadBytes, o.destinationIpAddress, o.destinationPort, o.packetOptions())
+	} else {
+		receivedBuffer, err = exchange(config, payloadBytes, o.destinationIpAddress, o.destinationPort, o.packetOptions())
+	}
+	var handshakeErr *handshakeError
+	if errors.As(err, &handshakeErr) {
+		fail(handshakeExitCode(handshakeErr.err), handshakeErr.err)
+	}
+	if err != nil {
+		fail(exchangeExitCode(err), err)
 	}
 
-	if !valid {
-		flag.PrintDefaults()
-		os.Exit(1)
+	if output == outputJSON && responseFormat == "" {
+		// the response may be binary
+		responseFormat = format.Base64
 	}
 
-	config := wireguard.Configuration {
-		PrivateKey: privateKey,
-		PublicKey: publicKey,
-		Endpoint: endpoint,
-		ClientIpAddress: clientIpAddress,
+	response, err := format.Encode(responseFormat, receivedBuffer)
+	if err != nil {
+		fail(exitFailure, err)
 	}
 
-	receivedBuffer, err := wireguard.UdpOneShot(payloadBytes, destinationIpAddress, destinationPort, config)
+	if output == outputJSON {
+		printJSON(result{
+			DestinationIpAddress: o.destinationIpAddress,
+			DestinationPort:      o.destinationPort,
+			Response:             response,
+			ResponseFormat:       responseFormat,
+			Length:               len(receivedBuffer),
+		})
+		return
+	}
+
+	fmt.Println(response)
+}
+
+// handshakeError marks errors from establishing the tunnel, which have their
+// own exit codes.
+type handshakeError struct {
+	err error
+}
+
+func (e *handshakeError) Error() string { return e.err.Error() }
+func (e *handshakeError) Unwrap() error { return e.err }
+
+// deadline is the time a request started now may take, no limit for a zero
+// timeout.
+func deadline(timeout time.Duration) time.Time {
+	if timeout > 0 {
+		return time.Now().Add(timeout)
+	}
+	return time.Time{}
+}
+
+func exchange(config wireguard.Configuration, payload []byte, destinationIpAddress string, destinationPort int, packet wireguard.PacketOptions) ([]byte, error) {
+	tunnel, err := wireguard.Dial(config)
+	if err != nil {
+		return nil, &handshakeError{err}
+	}
+	defer tunnel.Close()
+
+	tunnel.SetReadDeadline(deadline(config.Timeout))
+	return tunnel.UdpOneShotWithOptions(payload, destinationIpAddress, destinationPort, packet)
+}
+
+func exchangeCached(config wireguard.Configuration, payload []byte, destinationIpAddress string, destinationPort int, packet wireguard.PacketOptions) ([]byte, error) {
+	cache, err := openSessionCache(config)
+	if err != nil {
+		return nil, &handshakeError{err}
+	}
+
+	tunnel, resumed, err := cache.dial(config, config.Timeout)
+	if err != nil {
+		return nil, &handshakeError{err}
+	}
+
+	tunnel.SetReadDeadline(deadline(config.Timeout))
+	receivedBuffer, err := tunnel.UdpOneShotWithOptions(payload, destinationIpAddress, destinationPort, packet)
+	if err == nil {
+		// the reply is in hand either way
+		cache.received(tunnel.State())
+	}
+	tunnel.Close()
+	if !resumed || !sessionFailed(err) {
+		return receivedBuffer, err
+	}
+
+	// The peer may have dropped the session (restart, rekey) and the reply
+	// either failed to decrypt or never came. Start over with a handshake.
+	cache.remove()
+	tunnel, _, err = cache.dial(config, config.Timeout)
 	if err != nil {
-		fmt.Println(err)
+		return nil, &handshakeError{err}
+	}
+
+	tunnel.SetReadDeadline(deadline(config.Timeout))
+	receivedBuffer, err = tunnel.UdpOneShotWithOptions(payload, destinationIpAddress, destinationPort, packet)
+	if err == nil {
+		cache.received(tunnel.State())
 	}
+	tunnel.Close()
+	return receivedBuffer, err
+}
 
-	fmt.Println(string(receivedBuffer))
-}
\ No newline at end of file
+func readPayloadFile(path string) (string, error) {
+	var data []byte
+	var err error
+	if path == "-" {
+		data, err = ioutil.ReadAll(os.Stdin)
+	} else {
+		data, err = ioutil.ReadFile(path)
+	}
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
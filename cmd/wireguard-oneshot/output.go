@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+
+	"github.com/1stship/wireguard-oneshot"
+)
+
+const (
+	outputText   = "text"
+	outputHex    = "hex"
+	outputBase64 = "base64"
+	outputJSON   = "json"
+)
+
+// Exit codes, so that scripts can tell failures apart.
+const (
+	exitFailure   = 1
+	exitConfig    = 2 // invalid flags, profile, payload or keys
+	exitHandshake = 3
+	exitTimeout   = 4
+	exitDecrypt   = 5
+)
+
+var errorClasses = map[int]string{
+	exitFailure:   "failure",
+	exitConfig:    "config",
+	exitHandshake: "handshake",
+	exitTimeout:   "timeout",
+	exitDecrypt:   "decrypt",
+}
+
+var output = outputText
+
+type result struct {
+	DestinationIpAddress string `json:"destinationIpAddress"`
+	DestinationPort      int    `json:"destinationPort"`
+	Response             string `json:"response"`
+	ResponseFormat       string `json:"responseFormat"`
+	Length               int    `json:"length"`
+}
+
+type errorResult struct {
+	Error      string `json:"error"`
+	ErrorClass string `json:"errorClass"`
+}
+
+// fail reports message on stderr (and as JSON on stdout with -output json)
+// and exits with code.
+func fail(code int, message interface{}) {
+	fmt.Fprintln(os.Stderr, message)
+	if output == outputJSON {
+		printJSON(errorResult{
+			Error:      fmt.Sprint(message),
+			ErrorClass: errorClasses[code],
+		})
+	}
+	os.Exit(code)
+}
+
+func printJSON(v interface{}) {
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetEscapeHTML(false)
+	encoder.Encode(v)
+}
+
+func handshakeExitCode(err error) int {
+	var addrErr *net.AddrError
+	switch {
+	case isTimeout(err):
+		return exitTimeout
+	case errors.Is(err, wireguard.ErrInvalidPrivateKey), errors.Is(err, wireguard.ErrInvalidPublicKey), errors.Is(err, wireguard.ErrInvalidPresharedKey), errors.Is(err, wireguard.ErrInvalidAddress), errors.Is(err, wireguard.ErrInvalidMTU), errors.As(err, &addrErr):
+		return exitConfig
+	default:
+		return exitHandshake
+	}
+}
+
+func exchangeExitCode(err error) int {
+	switch {
+	case isTimeout(err):
+		return exitTimeout
+	case errors.Is(err, wireguard.ErrDecryptFailed):
+		return exitDecrypt
+	case errors.Is(err, wireguard.ErrPayloadTooLarge), errors.Is(err, wireguard.ErrInvalidAddress):
+		return exitConfig
+	default:
+		return exitFailure
+	}
+}
+
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/1stship/wireguard-oneshot/internal/profile"
+)
+
+func profileCommand(args []string) {
+	if len(args) == 0 {
+		profileUsage()
+	}
+
+	var err error
+	switch args[0] {
+	case "list":
+		err = profileList()
+	case "show":
+		err = profileShow(args[1:])
+	case "add":
+		err = profileAdd(args[1:])
+	case "remove":
+		err = profileRemove(args[1:])
+	default:
+		profileUsage()
+	}
+
+	if err != nil {
+		fail(exitFailure, err)
+	}
+}
+
+func profileUsage() {
+	fail(exitConfig, "usage: wireguard-oneshot profile list|show|add|remove")
+}
+
+func openProfiles() (*profile.Store, string, error) {
+	path, err := profile.Path()
+	if err != nil {
+		return nil, "", err
+	}
+
+	store, err := profile.Open(path)
+	if err != nil {
+		return nil, "", err
+	}
+	return store, path, nil
+}
+
+func profileList() error {
+	store, _, err := openProfiles()
+	if err != nil {
+		return err
+	}
+
+	for _, name := range store.Names() {
+		fmt.Printf("%s\t%s\n", name, store.Profiles[name].Endpoint)
+	}
+	return nil
+}
+
+func profileShow(args []string) error {
+	var showPrivateKey bool
+	flagSet := flag.NewFlagSet("profile show", flag.ExitOnError)
+	flagSet.BoolVar(&showPrivateKey, "showPrivateKey", false, "秘密鍵を表示する")
+	name, err := parseProfileArgs(flagSet, args)
+	if err != nil {
+		return err
+	}
+
+	store, _, err := openProfiles()
+	if err != nil {
+		return err
+	}
+
+	p, err := store.Get(name)
+	if err != nil {
+		return err
+	}
+
+	privateKey := "(hidden)"
+	if showPrivateKey {
+		privateKey = p.PrivateKey
+	}
+
+	fmt.Printf("name:            %s\n", name)
+	fmt.Printf("privateKey:      %s\n", privateKey)
+	fmt.Printf("publicKey:       %s\n", p.PublicKey)
+	fmt.Printf("endpoint:        %s\n", p.Endpoint)
+	fmt.Printf("clientIpAddress: %s\n", p.ClientIpAddress)
+	return nil
+}
+
+func profileAdd(args []string) error {
+	var p profile.Profile
+	var force bool
+	flagSet := flag.NewFlagSet("profile add", flag.ExitOnError)
+	flagSet.StringVar(&p.PrivateKey, "privateKey", "", "サーバーの秘密鍵(-で標準入力から読み込む)")
+	flagSet.StringVar(&p.PublicKey, "publicKey", "", "サーバーの公開鍵")
+	flagSet.StringVar(&p.Endpoint, "endpoint", "", "サーバーのエンドポイント")
+	flagSet.StringVar(&p.ClientIpAddress, "clientIpAddress", "", "クライアントのIPアドレス")
+	flagSet.BoolVar(&force, "force", false, "既存のプロファイルを上書きする")
+	name, err := parseProfileArgs(flagSet, args)
+	if err != nil {
+		return err
+	}
+
+	if p.PrivateKey == "-" {
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && line == "" {
+			return err
+		}
+		p.PrivateKey = strings.TrimSpace(line)
+	}
+
+	if p.PrivateKey == "" || p.PublicKey == "" || p.Endpoint == "" || p.ClientIpAddress == "" {
+		flagSet.PrintDefaults()
+		return fmt.Errorf("privateKey, publicKey, endpoint and clientIpAddress must not be empty.")
+	}
+
+	store, path, err := openProfiles()
+	if err != nil {
+		return err
+	}
+
+	_, exists := store.Profiles[name]
+	if exists && !force {
+		return fmt.Errorf("profile %q already exists, use -force to overwrite", name)
+	}
+
+	store.Profiles[name] = p
+	return store.Save(path)
+}
+
+func profileRemove(args []string) error {
+	flagSet := flag.NewFlagSet("profile remove", flag.ExitOnError)
+	name, err := parseProfileArgs(flagSet, args)
+	if err != nil {
+		return err
+	}
+
+	store, path, err := openProfiles()
+	if err != nil {
+		return err
+	}
+
+	err = store.Remove(name)
+	if err != nil {
+		return err
+	}
+	return store.Save(path)
+}
+
+// Accepts the profile name before or after the flags.
+func parseProfileArgs(flagSet *flag.FlagSet, args []string) (string, error) {
+	var name string
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		name = args[0]
+		args = args[1:]
+	}
+	flagSet.Parse(args)
+
+	if name == "" {
+		name = flagSet.Arg(0)
+	}
+	if name == "" {
+		return "", fmt.Errorf("profile name must not be empty.")
+	}
+	return name, nil
+}
+
+// Values given on the command line take precedence over the profile.
+func applyProfile(name string, privateKey *string, publicKey *string, endpoint *string, clientIpAddress *string) error {
+	p, err := profile.Lookup(name)
+	if err != nil {
+		return err
+	}
+
+	if *privateKey == "" {
+		*privateKey = p.PrivateKey
+	}
+	if *publicKey == "" {
+		*publicKey = p.PublicKey
+	}
+	if *endpoint == "" {
+		*endpoint = p.Endpoint
+	}
+	if *clientIpAddress == "" {
+		*clientIpAddress = p.ClientIpAddress
+	}
+	return nil
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/1stship/wireguard-oneshot"
+	"golang.org/x/crypto/blake2s"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+const (
+	sessionCacheContext = "wireguard-oneshot session cache"
+	sessionLockWait     = 5 * time.Second
+)
+
+// sessionCache keeps one established session per (private key, public key,
+// endpoint, client address) on disk, so that runs within REJECT_AFTER_TIME
+// can skip the handshake. The file is sealed with a key derived from the
+// private key, and an OS lock on a lock file serializes processes sharing it.
+type sessionCache struct {
+	path string
+	id   []byte
+	key  [chacha20poly1305.KeySize]byte
+}
+
+func openSessionCache(config wireguard.Configuration) (*sessionCache, error) {
+	privateKey, err := base64.StdEncoding.DecodeString(config.PrivateKey)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", wireguard.ErrInvalidPrivateKey, err)
+	}
+
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return nil, err
+	}
+
+	id := sha256.Sum256([]byte(config.PrivateKey + "\n" + config.PublicKey + "\n" + config.Endpoint + "\n" + config.ClientIpAddress))
+	cache := &sessionCache{
+		path: filepath.Join(dir, "wireguard-oneshot", "sessions", hex.EncodeToString(id[:])),
+		id:   id[:],
+		key:  blake2s.Sum256(append([]byte(sessionCacheContext), privateKey...)),
+	}
+	return cache, nil
+}
+
+// dial returns a tunnel resumed from the cache, or a new one when there
+// is nothing usable. Either way the counter the caller is going to send with
+// has been written back as used before it returns.
+//
+// The lock is held through the handshake, so that processes started together
+// resume the new session instead of replacing it at the peer with their own.
+// They wait for as long as the handshake may take.
+func (c *sessionCache) dial(config wireguard.Configuration, timeout time.Duration) (tunnel *wireguard.Tunnel, resumed bool, err error) {
+	unlock, err := c.lock(handshakeLimit(timeout) + sessionLockWait)
+	if err != nil {
+		return nil, false, err
+	}
+	defer unlock()
+
+	state, err := c.load()
+	if err == nil && sessionUsable(state.Created, timeout) {
+		tunnel, err = wireguard.Resume(config, *state)
+		if err == nil {
+			return tunnel, true, c.reserve(tunnel.State())
+		}
+		// most likely the local port is taken now; fall through to a handshake
+	}
+
+	tunnel, err = wireguard.Dial(config)
+	if err != nil {
+		return nil, false, err
+	}
+	err = c.reserve(tunnel.State())
+	if err != nil {
+		tunnel.Close()
+		return nil, false, err
+	}
+	return tunnel, false, nil
+}
+
+// handshakeLimit is how long wireguard.Dial tries with the given timeout.
+func handshakeLimit(timeout time.Duration) time.Duration {
+	if timeout > 0 && timeout < wireguard.RekeyAttemptTime {
+		return timeout
+	}
+	return wireguard.RekeyAttemptTime
+}
+
+// reserve stores the state with the next counter marked as used. A run that
+// dies before sending only wastes a counter, never reuses one.
+func (c *sessionCache) reserve(state wireguard.SessionState) error {
+	state.SendNonce++
+	return c.save(state)
+}
+
+// received stores how far the peer's counter got, so that a later run rejects
+// the replies of this one if they are replayed. The counter we send with may
+// have been reserved further meanwhile and is left alone.
+func (c *sessionCache) received(state wireguard.SessionState) error {
+	unlock, err := c.lock(sessionLockWait)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	saved, err := c.load()
+	if err != nil {
+		return err
+	}
+	if saved.LocalIndex != state.LocalIndex || saved.ReceiveNonce >= state.ReceiveNonce {
+		// replaced by another session, or already further
+		return nil
+	}
+	saved.ReceiveNonce = state.ReceiveNonce
+	return c.save(*saved)
+}
+
+func (c *sessionCache) load() (*wireguard.SessionState, error) {
+	sealed, err := ioutil.ReadFile(c.path)
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := chacha20poly1305.NewX(c.key[:])
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < aead.NonceSize() {
+		return nil, errors.New("session cache is truncated")
+	}
+
+	data, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], c.id)
+	if err != nil {
+		return nil, err
+	}
+
+	var state wireguard.SessionState
+	err = json.Unmarshal(data, &state)
+	if err != nil {
+		return nil, err
+	}
+	return &state, nil
+}
+
+func (c *sessionCache) save(state wireguard.SessionState) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+
+	aead, err := chacha20poly1305.NewX(c.key[:])
+	if err != nil {
+		return err
+	}
+
+	sealed := make([]byte, aead.NonceSize(), aead.NonceSize()+len(data)+aead.Overhead())
+	_, err = rand.Read(sealed)
+	if err != nil {
+		return err
+	}
+	sealed = aead.Seal(sealed, sealed, data, c.id)
+
+	err = os.MkdirAll(filepath.Dir(c.path), 0700)
+	if err != nil {
+		return err
+	}
+
+	file, err := ioutil.TempFile(filepath.Dir(c.path), ".session-*")
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(sealed)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(file.Name())
+		return err
+	}
+	return os.Rename(file.Name(), c.path)
+}
+
+func (c *sessionCache) remove() {
+	os.Remove(c.path)
+}
+
+// lock takes the lock on the cache within wait. The lock file is never
+// removed, and the OS drops the lock of a process that dies holding it.
+func (c *sessionCache) lock(wait time.Duration) (func(), error) {
+	err := os.MkdirAll(filepath.Dir(c.path), 0700)
+	if err != nil {
+		return nil, err
+	}
+
+	path := c.path + ".lock"
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	deadline := time.Now().Add(wait)
+	for {
+		locked, err := tryLockFile(file)
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+		if locked {
+			// closing the file releases the lock
+			return func() { file.Close() }, nil
+		}
+
+		if time.Now().After(deadline) {
+			file.Close()
+			return nil, fmt.Errorf("session cache is locked: %s", path)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+// As the initiator we stop sending on a session after REKEY_AFTER_TIME, and the
+// reply must arrive before the peer rejects the keypair at REJECT_AFTER_TIME.
+func sessionUsable(created time.Time, timeout time.Duration) bool {
+	age := time.Since(created)
+	return age < wireguard.RekeyAfterTime && age+timeout < wireguard.RejectAfterTime
+}
+
+func sessionFailed(err error) bool {
+	return errors.Is(err, wireguard.ErrDecryptFailed) || isTimeout(err)
+}
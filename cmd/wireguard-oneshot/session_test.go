@@ -0,0 +1,167 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/1stship/wireguard-oneshot"
+	"github.com/1stship/wireguard-oneshot/wgtest"
+)
+
+func testSessionCache(t *testing.T, config wireguard.Configuration) *sessionCache {
+	t.Helper()
+	cache, err := openSessionCache(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache.path = filepath.Join(t.TempDir(), "session")
+	return cache
+}
+
+func TestSessionCacheRoundTrip(t *testing.T) {
+	server := wgtest.NewServer(wgtest.Echo)
+	defer server.Close()
+	cache := testSessionCache(t, server.Configuration())
+
+	state := wireguard.SessionState{
+		LocalIndex:   1,
+		RemoteIndex:  2,
+		SendNonce:    3,
+		ReceiveNonce: 6,
+		Created:      time.Now().Round(0),
+		LocalAddress: "127.0.0.1:4000",
+	}
+	state.SendKey[0] = 4
+	state.ReceiveKey[0] = 5
+
+	err := cache.save(state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := cache.load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !loaded.Created.Equal(state.Created) {
+		t.Errorf("Created = %v, want %v", loaded.Created, state.Created)
+	}
+	loaded.Created = state.Created
+	if *loaded != state {
+		t.Errorf("loaded %+v, want %+v", *loaded, state)
+	}
+
+	info, err := os.Stat(cache.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("mode %v, want 0600", info.Mode().Perm())
+	}
+
+	// another key cannot open it
+	other := server.Configuration()
+	other.PrivateKey, _, err = wgtest.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherCache := testSessionCache(t, other)
+	otherCache.path = cache.path
+	_, err = otherCache.load()
+	if err == nil {
+		t.Error("loaded the session with another private key")
+	}
+}
+
+func TestSessionCacheReservesCounter(t *testing.T) {
+	server := wgtest.NewServer(wgtest.Echo)
+	defer server.Close()
+	config := server.Configuration()
+	cache := testSessionCache(t, config)
+
+	tunnel, resumed, err := cache.dial(config, config.Timeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resumed {
+		t.Error("resumed from an empty cache")
+	}
+	first := tunnel.State()
+	tunnel.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = tunnel.UdpOneShot([]byte("hello"), wgtest.IpAddress, 7)
+	tunnel.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the reply is recorded without taking back the reserved counter
+	err = cache.received(tunnel.State())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the saved counter is past the one the first run sent with
+	saved, err := cache.load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if saved.LocalIndex != first.LocalIndex || saved.SendNonce != first.SendNonce+1 {
+		t.Fatalf("saved index %d counter %d, want %d and %d", saved.LocalIndex, saved.SendNonce, first.LocalIndex, first.SendNonce+1)
+	}
+	if saved.ReceiveNonce == 0 {
+		t.Error("the reply was not saved")
+	}
+
+	tunnel, resumed, err = cache.dial(config, config.Timeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tunnel.Close()
+	if !resumed {
+		t.Fatal("did not resume the cached session")
+	}
+	if tunnel.State().SendNonce != saved.SendNonce {
+		t.Errorf("resumed with counter %d, want %d", tunnel.State().SendNonce, saved.SendNonce)
+	}
+	again, err := cache.load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again.SendNonce != saved.SendNonce+1 {
+		t.Errorf("saved counter %d, want %d", again.SendNonce, saved.SendNonce+1)
+	}
+
+	tunnel.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = tunnel.UdpOneShot([]byte("hello"), wgtest.IpAddress, 7)
+	if err != nil {
+		t.Errorf("exchange on the resumed session: %v", err)
+	}
+}
+
+func TestSessionCacheLock(t *testing.T) {
+	server := wgtest.NewServer(wgtest.Echo)
+	defer server.Close()
+	cache := testSessionCache(t, server.Configuration())
+
+	unlock, err := cache.lock(time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = cache.lock(100 * time.Millisecond)
+	if err == nil {
+		t.Fatal("locked the cache twice")
+	}
+
+	unlock()
+	unlock, err = cache.lock(time.Second)
+	if err != nil {
+		t.Fatalf("lock after unlock: %v", err)
+	}
+	unlock()
+
+	_, err = os.Stat(cache.path + ".lock")
+	if err != nil {
+		t.Errorf("lock file: %v", err)
+	}
+}
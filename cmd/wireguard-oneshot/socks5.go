@@ -0,0 +1,326 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"time"
+
+	"github.com/1stship/wireguard-oneshot"
+)
+
+const (
+	socks5Version = 0x05
+
+	socks5MethodNoAuth       = 0x00
+	socks5MethodNoAcceptable = 0xff
+
+	socks5CommandConnect      = 0x01
+	socks5CommandUdpAssociate = 0x03
+
+	socks5AddressIPv4   = 0x01
+	socks5AddressDomain = 0x03
+	socks5AddressIPv6   = 0x04
+
+	socks5ReplySucceeded           = 0x00
+	socks5ReplyGeneralFailure      = 0x01
+	socks5ReplyCommandNotSupported = 0x07
+	socks5ReplyAddressNotSupported = 0x08
+)
+
+var errSocks5AddressNotSupported = errors.New("address type not supported")
+
+func socks5Command(args []string) {
+	var o options
+	var listen string
+	var persistentKeepalive time.Duration
+	flagSet := flag.NewFlagSet("socks5", flag.ExitOnError)
+	o.bindConnection(flagSet)
+	flagSet.StringVar(&listen, "listen", "127.0.0.1:1080", "SOCKS5サーバーの待ち受けアドレス")
+	flagSet.DurationVar(&persistentKeepalive, "persistentKeepalive", 0, "無通信時にキープアライブを送る間隔(0で無効)")
+	flagSet.Parse(args)
+
+	err := o.resolve(flagSet)
+	if err != nil {
+		fail(exitConfig, err)
+	}
+
+	if !o.validateConnection() {
+		flagSet.PrintDefaults()
+		fail(exitConfig, "Required arguments are missing.")
+	}
+
+	config := wireguard.Configuration{
+		PrivateKey:          o.privateKey,
+		PublicKey:           o.publicKey,
+		Endpoint:            o.endpoint,
+		ClientIpAddress:     o.clientIpAddress,
+		Timeout:             o.timeout,
+		MTU:                 o.mtu,
+		PersistentKeepalive: persistentKeepalive,
+	}
+
+	// the associations share the tunnel of the Client, each on a port of its own
+	client, err := wireguard.NewClient(config)
+	if err != nil {
+		fail(handshakeExitCode(err), err)
+	}
+
+	listener, err := net.Listen("tcp", listen)
+	if err != nil {
+		fail(exitFailure, err)
+	}
+	log.Printf("SOCKS5 server listening on %s", listener.Addr())
+
+	acceptSocks5(listener, client)
+}
+
+// acceptSocks5 serves the connections of listener until it is closed. Other
+// errors, e.g. running out of file descriptors, are waited out as net/http does.
+func acceptSocks5(listener net.Listener, client *wireguard.Client) {
+	var delay time.Duration
+	for {
+		conn, err := listener.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			delay *= 2
+			if delay == 0 {
+				delay = 5 * time.Millisecond
+			}
+			if delay > time.Second {
+				delay = time.Second
+			}
+			log.Printf("accept: %v; retrying in %v", err, delay)
+			time.Sleep(delay)
+			continue
+		}
+		delay = 0
+		go serveSocks5(conn, client)
+	}
+}
+
+func serveSocks5(conn net.Conn, client *wireguard.Client) {
+	defer conn.Close()
+
+	greeting := make([]byte, 2)
+	_, err := io.ReadFull(conn, greeting)
+	if err != nil || greeting[0] != socks5Version {
+		return
+	}
+
+	methods := make([]byte, greeting[1])
+	_, err = io.ReadFull(conn, methods)
+	if err != nil {
+		return
+	}
+
+	if !bytes.Contains(methods, []byte{socks5MethodNoAuth}) {
+		conn.Write([]byte{socks5Version, socks5MethodNoAcceptable})
+		return
+	}
+	conn.Write([]byte{socks5Version, socks5MethodNoAuth})
+
+	request := make([]byte, 3)
+	_, err = io.ReadFull(conn, request)
+	if err != nil || request[0] != socks5Version {
+		return
+	}
+
+	_, _, err = readSocks5Address(conn)
+	if err == errSocks5AddressNotSupported {
+		writeSocks5Reply(conn, socks5ReplyAddressNotSupported, nil)
+		return
+	}
+	if err != nil {
+		return
+	}
+
+	switch request[1] {
+	case socks5CommandUdpAssociate:
+		socks5UdpAssociate(conn, client)
+	default:
+		// CONNECT needs TCP over the tunnel, which is not implemented yet.
+		writeSocks5Reply(conn, socks5ReplyCommandNotSupported, nil)
+	}
+}
+
+func socks5UdpAssociate(conn net.Conn, client *wireguard.Client) {
+	localAddress := conn.LocalAddr().(*net.TCPAddr)
+	relay, err := net.ListenUDP("udp", &net.UDPAddr{IP: localAddress.IP})
+	if err != nil {
+		log.Println(err)
+		writeSocks5Reply(conn, socks5ReplyGeneralFailure, nil)
+		return
+	}
+	defer relay.Close()
+
+	tunnelConn, err := client.ListenPacket(0)
+	if err != nil {
+		log.Println(err)
+		writeSocks5Reply(conn, socks5ReplyGeneralFailure, nil)
+		return
+	}
+	defer tunnelConn.Close()
+
+	err = writeSocks5Reply(conn, socks5ReplySucceeded, relay.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		return
+	}
+
+	clientIp := conn.RemoteAddr().(*net.TCPAddr).IP
+	clientAddress := make(chan *net.UDPAddr, 1)
+	go socks5RelayToTunnel(conn, relay, tunnelConn, clientIp, clientAddress)
+	go socks5RelayFromTunnel(conn, relay, tunnelConn, clientAddress)
+
+	// The association lives as long as the TCP control connection, which is
+	// closed when the tunnel fails.
+	io.Copy(ioutil.Discard, conn)
+}
+
+func socks5RelayToTunnel(control net.Conn, relay *net.UDPConn, tunnelConn net.PacketConn, clientIp net.IP, clientAddress chan<- *net.UDPAddr) {
+	defer control.Close()
+
+	buffer := make([]byte, 65535)
+	var client *net.UDPAddr
+	for {
+		length, address, err := relay.ReadFromUDP(buffer)
+		if err != nil {
+			return
+		}
+
+		if !address.IP.Equal(clientIp) {
+			continue
+		}
+		if client == nil {
+			client = address
+			clientAddress <- client
+		}
+
+		// RSV(2) FRAG(1) ATYP(1) DST.ADDR DST.PORT DATA
+		if length < 4 || buffer[2] != 0 {
+			continue
+		}
+
+		reader := bytes.NewReader(buffer[3:length])
+		destinationIpAddress, destinationPort, err := readSocks5Address(reader)
+		if err != nil {
+			continue
+		}
+
+		ip := net.ParseIP(destinationIpAddress)
+		if ip == nil {
+			log.Printf("dropped datagram to %s: domain names are not supported", destinationIpAddress)
+			continue
+		}
+
+		// an address of the other family than ours is refused by WriteTo
+		payload := buffer[length-reader.Len() : length]
+		_, err = tunnelConn.WriteTo(payload, &net.UDPAddr{IP: ip, Port: destinationPort})
+		if errors.Is(err, wireguard.ErrPayloadTooLarge) || errors.Is(err, wireguard.ErrInvalidAddress) {
+			log.Printf("dropped datagram to %s: %v", destinationIpAddress, err)
+			continue
+		}
+		if err != nil {
+			log.Println(err)
+			return
+		}
+	}
+}
+
+func socks5RelayFromTunnel(control net.Conn, relay *net.UDPConn, tunnelConn net.PacketConn, clientAddress <-chan *net.UDPAddr) {
+	defer control.Close()
+
+	buffer := make([]byte, 65535)
+	var client *net.UDPAddr
+	for {
+		length, address, err := tunnelConn.ReadFrom(buffer)
+		if err != nil {
+			return
+		}
+		source := address.(*net.UDPAddr)
+
+		if client == nil {
+			select {
+			case client = <-clientAddress:
+			default:
+				continue
+			}
+		}
+
+		packet := append([]byte{0, 0, 0}, socks5Address(source.IP, source.Port)...)
+		packet = append(packet, buffer[:length]...)
+		relay.WriteToUDP(packet, client)
+	}
+}
+
+func readSocks5Address(reader io.Reader) (string, int, error) {
+	addressType := make([]byte, 1)
+	_, err := io.ReadFull(reader, addressType)
+	if err != nil {
+		return "", 0, err
+	}
+
+	var host string
+	switch addressType[0] {
+	case socks5AddressIPv4, socks5AddressIPv6:
+		address := make([]byte, net.IPv4len)
+		if addressType[0] == socks5AddressIPv6 {
+			address = make([]byte, net.IPv6len)
+		}
+		_, err = io.ReadFull(reader, address)
+		if err != nil {
+			return "", 0, err
+		}
+		host = net.IP(address).String()
+	case socks5AddressDomain:
+		length := make([]byte, 1)
+		_, err = io.ReadFull(reader, length)
+		if err != nil {
+			return "", 0, err
+		}
+		domain := make([]byte, length[0])
+		_, err = io.ReadFull(reader, domain)
+		if err != nil {
+			return "", 0, err
+		}
+		host = string(domain)
+	default:
+		return "", 0, errSocks5AddressNotSupported
+	}
+
+	port := make([]byte, 2)
+	_, err = io.ReadFull(reader, port)
+	if err != nil {
+		return "", 0, err
+	}
+
+	return host, int(binary.BigEndian.Uint16(port)), nil
+}
+
+func writeSocks5Reply(conn net.Conn, reply byte, address *net.UDPAddr) error {
+	if address == nil {
+		address = &net.UDPAddr{IP: net.IPv4zero}
+	}
+
+	packet := append([]byte{socks5Version, reply, 0}, socks5Address(address.IP, address.Port)...)
+	_, err := conn.Write(packet)
+	return err
+}
+
+// socks5Address encodes ATYP, ADDR and PORT for an IPv4 or IPv6 address.
+func socks5Address(ip net.IP, port int) []byte {
+	var address []byte
+	if ip4 := ip.To4(); ip4 != nil {
+		address = append([]byte{socks5AddressIPv4}, ip4...)
+	} else {
+		address = append([]byte{socks5AddressIPv6}, ip.To16()...)
+	}
+	return append(address, byte(port>>8), byte(port))
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/1stship/wireguard-oneshot"
+	"github.com/1stship/wireguard-oneshot/wgtest"
+)
+
+func TestSocks5Address(t *testing.T) {
+	tests := []struct {
+		name    string
+		encoded []byte
+		host    string
+		port    int
+		fails   bool
+	}{
+		{"IPv4", []byte{socks5AddressIPv4, 10, 0, 0, 1, 0x16, 0x33}, "10.0.0.1", 5683, false},
+		{"IPv6", append(append([]byte{socks5AddressIPv6}, net.ParseIP("fd00::1")...), 0, 7), "fd00::1", 7, false},
+		{"domain", []byte{socks5AddressDomain, 4, 'h', 'o', 's', 't', 0, 53}, "host", 53, false},
+		{"unknown type", []byte{0x05, 10, 0, 0, 1, 0, 7}, "", 0, true},
+		{"truncated address", []byte{socks5AddressIPv6, 0xfd, 0}, "", 0, true},
+		{"truncated port", []byte{socks5AddressIPv4, 10, 0, 0, 1, 0}, "", 0, true},
+		{"empty", nil, "", 0, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			host, port, err := readSocks5Address(bytes.NewReader(test.encoded))
+			if test.fails {
+				if err == nil {
+					t.Errorf("read %s:%d, want an error", host, port)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if host != test.host || port != test.port {
+				t.Errorf("read %s:%d, want %s:%d", host, port, test.host, test.port)
+			}
+
+			ip := net.ParseIP(test.host)
+			if ip == nil {
+				return
+			}
+			if encoded := socks5Address(ip, test.port); !bytes.Equal(encoded, test.encoded) {
+				t.Errorf("socks5Address = %x, want %x", encoded, test.encoded)
+			}
+		})
+	}
+}
+
+func TestSocks5UdpAssociate(t *testing.T) {
+	server := wgtest.NewServer(wgtest.Echo)
+	defer server.Close()
+
+	client, err := wireguard.NewClient(server.Configuration())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	go func() {
+		acceptSocks5(listener, client)
+		close(done)
+	}()
+	defer func() {
+		listener.Close()
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Error("accept loop still running after the listener was closed")
+		}
+	}()
+
+	control, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer control.Close()
+	control.SetDeadline(time.Now().Add(5 * time.Second))
+
+	_, err = control.Write([]byte{socks5Version, 1, socks5MethodNoAuth})
+	if err != nil {
+		t.Fatal(err)
+	}
+	method := make([]byte, 2)
+	_, err = io.ReadFull(control, method)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if method[1] != socks5MethodNoAuth {
+		t.Fatalf("method %d, want no authentication", method[1])
+	}
+
+	request := append([]byte{socks5Version, socks5CommandUdpAssociate, 0}, socks5Address(net.IPv4zero, 0)...)
+	_, err = control.Write(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reply := make([]byte, 3)
+	_, err = io.ReadFull(control, reply)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reply[1] != socks5ReplySucceeded {
+		t.Fatalf("reply %d, want succeeded", reply[1])
+	}
+	host, port, err := readSocks5Address(control)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	relay, err := net.Dial("udp", net.JoinHostPort(host, strconv.Itoa(port)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer relay.Close()
+	relay.SetDeadline(time.Now().Add(5 * time.Second))
+
+	destination := socks5Address(net.ParseIP(wgtest.IpAddress), 7)
+	_, err = relay.Write(append(append([]byte{0, 0, 0}, destination...), "hello"...))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buffer := make([]byte, 1500)
+	length, err := relay.Read(buffer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := append(append([]byte{0, 0, 0}, destination...), "hello"...)
+	if !bytes.Equal(buffer[:length], want) {
+		t.Errorf("relayed %x, want %x", buffer[:length], want)
+	}
+}
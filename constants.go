@@ -0,0 +1,17 @@
+package wireguard
+
+import "time"
+
+const (
+	RekeyAfterMessages  = (1 << 60)
+	RejectAfterMessages = (1 << 64) - (1 << 13) - 1
+	RekeyAfterTime      = time.Second * 120
+	RekeyAttemptTime    = time.Second * 90
+	RekeyTimeout        = time.Second * 5
+	RejectAfterTime     = time.Second * 180
+	KeepaliveTimeout    = time.Second * 10
+	CookieRefreshTime   = time.Second * 120
+
+	// peers drop initiations from one key coming faster than this
+	HandshakeInitiationRate = time.Second / 50
+)
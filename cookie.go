@@ -1,6 +1,7 @@
 package wireguard
 
 import (
+	"crypto/hmac"
 	"time"
 
 	"golang.org/x/crypto/blake2s"
@@ -18,6 +19,14 @@ type CookieGenerator struct {
 		lastMAC1      [blake2s.Size128]byte
 		encryptionKey [chacha20poly1305.KeySize]byte
 	}
+	now func() time.Time
+}
+
+// CookieChecker verifies the MACs of messages sent to us.
+type CookieChecker struct {
+	mac1 struct {
+		key [blake2s.Size]byte
+	}
 }
 
 const (
@@ -25,10 +34,11 @@ const (
 	WGLabelCookie     = "cookie--"
 )
 
-func (st *CookieGenerator) init(pk NoisePublicKey) {
+func (st *CookieGenerator) init(pk NoisePublicKey, now func() time.Time) {
 	st.initMac1(pk)
 	st.initMac2(pk)
 	st.mac2.cookieSet = time.Time{}
+	st.now = now
 }
 
 func (st *CookieGenerator) initMac1(pk NoisePublicKey) {
@@ -61,7 +71,52 @@ func (st *CookieGenerator) addMacs(msg []byte) {
 	copy(st.mac2.lastMAC1[:], mac1)
 	st.mac2.hasLastMAC1 = true
 
+	// without a fresh cookie from the peer, mac2 is left zero
+	if st.now().Sub(st.mac2.cookieSet) > CookieRefreshTime {
+		setZero(mac2)
+		return
+	}
+
 	mac4, _ := blake2s.New128(st.mac2.cookie[:])
 	mac4.Write(msg[:smac2])
 	mac4.Sum(mac2[:0])
-}
\ No newline at end of file
+}
+
+// consumeReply takes the cookie from a cookie reply to our last message. The
+// message has to be sent again, with addMacs, for the cookie to be used.
+func (st *CookieGenerator) consumeReply(msg *MessageCookieReply) bool {
+	if !st.mac2.hasLastMAC1 {
+		return false
+	}
+
+	var cookie [blake2s.Size128]byte
+	xchapoly, _ := chacha20poly1305.NewX(st.mac2.encryptionKey[:])
+	_, err := xchapoly.Open(cookie[:0], msg.Nonce[:], msg.Cookie[:], st.mac2.lastMAC1[:])
+	if err != nil {
+		return false
+	}
+
+	st.mac2.cookieSet = st.now()
+	st.mac2.cookie = cookie
+	return true
+}
+
+func (st *CookieChecker) init(pk NoisePublicKey) {
+	hash, _ := blake2s.New256(nil)
+	hash.Write([]byte(WGLabelMAC1))
+	hash.Write(pk[:])
+	hash.Sum(st.mac1.key[:0])
+}
+
+func (st *CookieChecker) checkMAC1(msg []byte) bool {
+	size := len(msg)
+	smac2 := size - blake2s.Size128
+	smac1 := smac2 - blake2s.Size128
+
+	var mac1 [blake2s.Size128]byte
+	mac, _ := blake2s.New128(st.mac1.key[:])
+	mac.Write(msg[:smac1])
+	mac.Sum(mac1[:0])
+
+	return hmac.Equal(mac1[:], msg[smac1:smac2])
+}
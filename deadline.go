@@ -0,0 +1,56 @@
+package wireguard
+
+import (
+	"sync"
+	"time"
+)
+
+// deadline gives Tunnel the read deadline semantics of net.Conn: setting it
+// also affects a Receive that is already waiting.
+type deadline struct {
+	mutex  sync.Mutex
+	timer  *time.Timer
+	cancel chan struct{}
+}
+
+func newDeadline() *deadline {
+	return &deadline{cancel: make(chan struct{})}
+}
+
+func (d *deadline) set(t time.Time) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	// a timer that already fired closes the old channel
+	if d.timer != nil && !d.timer.Stop() {
+		d.cancel = make(chan struct{})
+	}
+	d.timer = nil
+
+	select {
+	case <-d.cancel:
+		d.cancel = make(chan struct{})
+	default:
+	}
+
+	if t.IsZero() {
+		return
+	}
+
+	duration := time.Until(t)
+	if duration <= 0 {
+		close(d.cancel)
+		return
+	}
+
+	cancel := d.cancel
+	d.timer = time.AfterFunc(duration, func() {
+		close(cancel)
+	})
+}
+
+func (d *deadline) wait() <-chan struct{} {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return d.cancel
+}
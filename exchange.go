@@ -0,0 +1,177 @@
+package wireguard
+
+import (
+	"errors"
+	"net"
+	"os"
+	"time"
+)
+
+var (
+	ErrNoSourcePort = errors.New("no free source port")
+	ErrPortInUse    = errors.New("port in use")
+)
+
+// Requests are sent from the dynamic ports of RFC 6335.
+const (
+	sourcePortFirst = 49152
+	sourcePortCount = 16384
+)
+
+// binding takes the datagrams sent to one of our ports inside the tunnel.
+type binding interface {
+	// receive reports whether the datagram was taken, otherwise it goes to
+	// Receive
+	receive(datagram *Datagram) bool
+	fail(err error)
+}
+
+// waiter is a request waiting for its reply. It is bound to the source port it
+// was sent from; the reply has to come back from where it went.
+type waiter struct {
+	remoteIp   net.IP
+	remotePort int
+	reply      chan receiveResult
+}
+
+func (w *waiter) receive(datagram *Datagram) bool {
+	if datagram.SourcePort != w.remotePort || !net.ParseIP(datagram.SourceIpAddress).Equal(w.remoteIp) {
+		return false
+	}
+
+	select {
+	case w.reply <- receiveResult{datagram: datagram}:
+	default:
+		// a duplicate; the first reply is the answer
+	}
+	return true
+}
+
+func (w *waiter) fail(err error) {
+	select {
+	case w.reply <- receiveResult{err: err}:
+	default:
+	}
+}
+
+// Exchange sends payload from a source port of its own and waits until deadline
+// for the reply, a zero deadline meaning no limit. Unlike UdpOneShot it may be
+// called concurrently: a single reader hands every reply to the request it
+// answers, and other datagrams to Receive.
+func (t *Tunnel) Exchange(payload []byte, destinationIpAddress string, destinationPort int, deadline time.Time) ([]byte, error) {
+	return t.ExchangeWithOptions(payload, destinationIpAddress, destinationPort, deadline, PacketOptions{})
+}
+
+// ExchangeWithOptions is Exchange with the given header fields. A fixed source
+// port fails with ErrPortInUse while another request or packet conn holds it.
+func (t *Tunnel) ExchangeWithOptions(payload []byte, destinationIpAddress string, destinationPort int, deadline time.Time, options PacketOptions) ([]byte, error) {
+	expired := newDeadline()
+	expired.set(deadline)
+	defer expired.set(time.Time{})
+
+	return t.exchange(payload, destinationIpAddress, destinationPort, expired, options)
+}
+
+// exchange ends when expired fires, which the caller may also make happen
+// early.
+func (t *Tunnel) exchange(payload []byte, destinationIpAddress string, destinationPort int, expired *deadline, options PacketOptions) ([]byte, error) {
+	err := options.validate()
+	if err != nil {
+		return nil, err
+	}
+
+	destinationIp := net.ParseIP(destinationIpAddress)
+	if destinationIp == nil {
+		return nil, ErrInvalidAddress
+	}
+
+	w := &waiter{
+		remoteIp:   destinationIp,
+		remotePort: destinationPort,
+		reply:      make(chan receiveResult, 1),
+	}
+	sourcePort, err := t.bind(w, options.SourcePort)
+	if err != nil {
+		return nil, err
+	}
+	defer t.unbind(sourcePort)
+
+	err = t.send(payload, t.config.ClientIpAddress, sourcePort, destinationIpAddress, destinationPort, options, expired.wait())
+	if err != nil {
+		return nil, err
+	}
+
+	select {
+	case result := <-w.reply:
+		if result.err != nil {
+			return nil, result.err
+		}
+		return result.datagram.Payload, nil
+	case <-expired.wait():
+		return nil, os.ErrDeadlineExceeded
+	case <-t.done:
+		return nil, t.err
+	}
+}
+
+// bind gives port to b, or a free port when port is zero.
+func (t *Tunnel) bind(b binding, port int) (int, error) {
+	t.bindingsMutex.Lock()
+	defer t.bindingsMutex.Unlock()
+
+	if port != 0 {
+		if _, ok := t.bindings[port]; ok {
+			return 0, ErrPortInUse
+		}
+		t.bindings[port] = b
+		return port, nil
+	}
+
+	if len(t.bindings) >= sourcePortCount {
+		return 0, ErrNoSourcePort
+	}
+
+	for {
+		n, err := randUint16(t.random)
+		if err != nil {
+			return 0, err
+		}
+
+		port = sourcePortFirst + int(n)%sourcePortCount
+		if _, ok := t.bindings[port]; !ok {
+			t.bindings[port] = b
+			return port, nil
+		}
+	}
+}
+
+func (t *Tunnel) unbind(port int) {
+	t.bindingsMutex.Lock()
+	defer t.bindingsMutex.Unlock()
+	delete(t.bindings, port)
+}
+
+// dispatch hands a datagram to the binding of its destination port, or to
+// Receive.
+func (t *Tunnel) dispatch(datagram *Datagram) {
+	t.bindingsMutex.Lock()
+	b, ok := t.bindings[datagram.DestinationPort]
+	t.bindingsMutex.Unlock()
+
+	if ok && b.receive(datagram) {
+		return
+	}
+	t.deliver(datagram, nil)
+}
+
+// fail reports a socket error to Receive and to every binding, as a connected
+// UDP socket would to its next read.
+func (t *Tunnel) fail(err error) {
+	t.bindingsMutex.Lock()
+	for _, b := range t.bindings {
+		b.fail(err)
+	}
+	t.bindingsMutex.Unlock()
+
+	t.deliver(nil, err)
+}
@@ -0,0 +1,189 @@
+package wireguard
+
+import (
+	"bytes"
+	"testing"
+)
+
+// The fuzz targets only check that nothing read from the network panics and
+// that whatever is accepted is consistent. Run one with e.g.
+//
+//	go test -fuzz FuzzConsumeResponse
+
+func fuzzInitiation(t testing.TB) (*initiation, NoisePrivateKey) {
+	_, clientEncoded := testKey(1)
+	serverPrivateKey, _ := testKey(101)
+	client, err := NewClient(Configuration{
+		PrivateKey: clientEncoded,
+		PublicKey:  testPublicKey(serverPrivateKey),
+		Rand:       &counterReader{},
+		Now:        fixedNow,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	initiation, err := client.createInitiation()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return initiation, serverPrivateKey
+}
+
+func FuzzConsumeResponse(f *testing.F) {
+	initiation, serverPrivateKey := fuzzInitiation(f)
+	received, err := consumeInitiation(initiation.packet, &serverPrivateKey)
+	if err != nil {
+		f.Fatal(err)
+	}
+	_, response, err := received.createResponse(&counterReader{next: 0x80}, fixedNow)
+	if err != nil {
+		f.Fatal(err)
+	}
+	f.Add(response)
+	f.Add(response[:MessageResponseSize-1])
+	f.Add(make([]byte, MessageCookieReplySize))
+
+	f.Fuzz(func(t *testing.T, packet []byte) {
+		initiation, _ := fuzzInitiation(t)
+		original := append([]byte(nil), initiation.packet...)
+
+		if initiation.consumeCookieReply(packet) {
+			t.Fatalf("accepted a cookie reply that was never sent: %x", packet)
+		}
+		if !bytes.Equal(initiation.packet, original) {
+			t.Fatal("a rejected cookie reply changed the initiation")
+		}
+
+		keypair, err := initiation.consumeResponse(packet)
+		if err == nil && (keypair == nil || len(packet) != MessageResponseSize) {
+			t.Fatalf("accepted a response of %d bytes", len(packet))
+		}
+	})
+}
+
+func FuzzConsumeInitiation(f *testing.F) {
+	initiation, _ := fuzzInitiation(f)
+	f.Add(initiation.packet)
+	f.Add(initiation.packet[:MessageInitiationSize-1])
+
+	f.Fuzz(func(t *testing.T, packet []byte) {
+		serverPrivateKey, _ := testKey(101)
+		received, err := consumeInitiation(packet, &serverPrivateKey)
+		if err != nil {
+			return
+		}
+		if len(packet) != MessageInitiationSize {
+			t.Fatalf("accepted an initiation of %d bytes", len(packet))
+		}
+		_, _, err = received.createResponse(&counterReader{next: 0x80}, fixedNow)
+		if err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+func fuzzKeypairs() *Keypairs {
+	var key [32]byte
+	for i := range key {
+		key[i] = byte(i)
+	}
+
+	// sending and receiving with the same key lets the seeds be sealed locally
+	keypair := newKeypair(key, key)
+	keypair.created = fixedNow()
+	keypair.localIndex = 1
+	keypair.remoteIndex = 1
+
+	keypairs := new(Keypairs)
+	keypairs.current = keypair
+	return keypairs
+}
+
+func FuzzOpenTransport(f *testing.F) {
+	keypair := fuzzKeypairs().current
+
+	header, err := createHeader([]byte("hello"), "10.0.0.2", 1234, "10.0.0.1", 7, PacketOptions{}, &counterReader{})
+	if err != nil {
+		f.Fatal(err)
+	}
+	for _, packet := range [][]byte{nil, append(header, []byte("hello")...)} {
+		sealed, err := sealTransport(packet, keypair)
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(sealed)
+	}
+	f.Add(make([]byte, MessageTransportSize-1))
+
+	f.Fuzz(func(t *testing.T, message []byte) {
+		_, packet, err := openTransport(fuzzKeypairs(), message, fixedNow())
+		if err != nil || packet == nil {
+			return
+		}
+
+		datagram, err := parseHeader(packet)
+		if err == nil && len(datagram.Payload) > len(packet) {
+			t.Fatalf("payload of %d bytes from a packet of %d", len(datagram.Payload), len(packet))
+		}
+	})
+}
+
+func FuzzParseHeader(f *testing.F) {
+	for _, addresses := range [][2]string{{"10.0.0.2", "10.0.0.1"}, {"fd00::2", "fd00::1"}} {
+		header, err := createHeader([]byte("hello"), addresses[0], 1234, addresses[1], 7, PacketOptions{}, &counterReader{})
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(append(header, []byte("hello")...))
+		f.Add(header)
+	}
+	f.Add([]byte{0x45})
+	f.Add([]byte{0x60})
+
+	f.Fuzz(func(t *testing.T, packet []byte) {
+		datagram, err := parseHeader(packet)
+		if err != nil {
+			return
+		}
+		if len(datagram.Payload) > len(packet)-IpHeaderSize-UdpHeaderSize {
+			t.Fatalf("payload of %d bytes from a packet of %d", len(datagram.Payload), len(packet))
+		}
+		if datagram.SourcePort < 0 || datagram.DestinationPort < 0 {
+			t.Fatalf("negative port in %+v", datagram)
+		}
+	})
+}
+
+func TestRejectsTruncatedMessages(t *testing.T) {
+	initiation, serverPrivateKey := fuzzInitiation(t)
+	received, err := consumeInitiation(initiation.packet, &serverPrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, response, err := received.createResponse(&counterReader{next: 0x80}, fixedNow)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = consumeInitiation(initiation.packet[:MessageInitiationSize-1], &serverPrivateKey)
+	if err != ErrInvalidPacket {
+		t.Errorf("truncated initiation: err = %v, want ErrInvalidPacket", err)
+	}
+	_, err = initiation.consumeResponse(append(response, 0))
+	if err != ErrInvalidPacket {
+		t.Errorf("oversized response: err = %v, want ErrInvalidPacket", err)
+	}
+
+	// a low order ephemeral gives an all zero shared secret
+	forged := append([]byte(nil), response...)
+	copy(forged[12:44], make([]byte, NoisePublicKeySize))
+	_, err = initiation.consumeResponse(forged)
+	if err != ErrInvalidPacket {
+		t.Errorf("low order ephemeral: err = %v, want ErrInvalidPacket", err)
+	}
+
+	_, err = initiation.consumeResponse(response)
+	if err != nil {
+		t.Errorf("response after rejected ones: %v", err)
+	}
+}
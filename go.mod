@@ -1,10 +1,9 @@
 module github.com/1stship/wireguard-oneshot
 
-go 1.17
+go 1.18
 
 require (
 	github.com/aws/aws-lambda-go v1.27.0
 	golang.org/x/crypto v0.0.0-20211202192323-5770296d904e
+	golang.org/x/sys v0.0.0-20210615035016-665e8c7367d1
 )
-
-require golang.org/x/sys v0.0.0-20210615035016-665e8c7367d1 // indirect
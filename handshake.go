@@ -3,6 +3,8 @@ package wireguard
 import (
 	"bytes"
 	"encoding/binary"
+	"errors"
+	"io"
 	"net"
 	"time"
 
@@ -41,6 +43,13 @@ type MessageResponse struct {
 	MAC2      [blake2s.Size128]byte
 }
 
+type MessageCookieReply struct {
+	Type     uint32
+	Receiver uint32
+	Nonce    [chacha20poly1305.NonceSizeX]byte
+	Cookie   [blake2s.Size128 + chacha20poly1305.Overhead]byte
+}
+
 const (
 	NoiseConstruction = "Noise_IKpsk2_25519_ChaChaPoly_BLAKE2s"
 	WGIdentifier      = "WireGuard v1 zx2c4 Jason@zx2c4.com"
@@ -68,34 +77,126 @@ var (
 	ZeroNonce       [chacha20poly1305.NonceSize]byte
 )
 
-func handshake(config Configuration) (*Keypair, net.Conn, error) {
-	handshake := new(Handshake)
-	handshake.chainKey = blake2s.Sum256([]byte(NoiseConstruction))
-	mixHash(&handshake.hash, &handshake.chainKey, []byte(WGIdentifier))
+var (
+	ErrInvalidPrivateKey   = errors.New("invalid private key")
+	ErrInvalidPublicKey    = errors.New("invalid public key")
+	ErrInvalidPresharedKey = errors.New("invalid preshared key")
+)
+
+// initiation is a handshake initiation message waiting for its response.
+type initiation struct {
+	handshake       Handshake
+	privateKey      NoisePrivateKey
+	cookieGenerator CookieGenerator
+	packet          []byte
+	sent            time.Time // by the tunnel's clock, for retransmitting a rekey
+	client          *Client
+}
 
-	var privateKey NoisePrivateKey
-	err := decodeBase64(privateKey[:], config.PrivateKey)
+// handshake sends a new initiation every REKEY_TIMEOUT until the peer responds,
+// giving up after REKEY_ATTEMPT_TIME or at deadline if sooner. A zero deadline
+// sets no limit of its own.
+func (c *Client) handshake(deadline time.Time) (*Keypair, net.Conn, error) {
+	conn, err := net.Dial("udp4", c.config.Endpoint)
 	if err != nil {
 		return nil, nil, err
 	}
-	privateKey.clamp()
-
-	publicKey := privateKey.publicKey()
 
-	var peerPublicKey NoisePublicKey
-	err = decodeBase64(peerPublicKey[:], config.PublicKey)
+	keypair, err := c.attemptHandshake(conn, deadline)
 	if err != nil {
+		conn.Close()
 		return nil, nil, err
 	}
+	conn.SetReadDeadline(time.Time{})
+	return keypair, conn, nil
+}
 
-	cookieGenerator := new(CookieGenerator)
-	cookieGenerator.init(peerPublicKey)
-	handshake.precomputedStaticStatic = privateKey.sharedSecret(peerPublicKey)
-	handshake.remoteStatic = peerPublicKey
-	handshake.localEphemeral, err = newPrivateKey()
+func (c *Client) attemptHandshake(conn net.Conn, deadline time.Time) (*Keypair, error) {
+	giveUp := time.Now().Add(RekeyAttemptTime)
+	if !deadline.IsZero() && deadline.Before(giveUp) {
+		giveUp = deadline
+	}
+
+	for {
+		initiation, err := c.createInitiation()
+		if err != nil {
+			return nil, err
+		}
+
+		_, err = conn.Write(initiation.packet)
+		if err != nil {
+			return nil, err
+		}
+		retransmit := time.Now().Add(RekeyTimeout)
+		if retransmit.After(giveUp) {
+			retransmit = giveUp
+		}
+		conn.SetReadDeadline(retransmit)
+
+		keypair, err := initiation.awaitResponse(conn)
+		if err == nil {
+			return keypair, nil
+		}
+
+		var netErr net.Error
+		if !errors.As(err, &netErr) || !netErr.Timeout() || !time.Now().Before(giveUp) {
+			return nil, err
+		}
+	}
+}
+
+// awaitResponse reads until the response to the initiation arrives or the read
+// deadline passes.
+func (i *initiation) awaitResponse(conn net.Conn) (*Keypair, error) {
+	buffer := make([]byte, UdpRecieveSize)
+	for {
+		length, err := conn.Read(buffer)
+		if err != nil {
+			return nil, err
+		}
+
+		// the peer is under load and wants the initiation again with its cookie
+		if length == MessageCookieReplySize && binary.LittleEndian.Uint32(buffer[0:4]) == MessageCookieReplyType {
+			if i.consumeCookieReply(buffer[:length]) {
+				_, err = conn.Write(i.packet)
+				if err != nil {
+					return nil, err
+				}
+			}
+			continue
+		}
+
+		// anything that is not our response is dropped, as a forged or
+		// stray packet must not end the handshake
+		keypair, err := i.consumeResponse(buffer[:length])
+		if err != nil {
+			continue
+		}
+		return keypair, nil
+	}
+}
 
+func (c *Client) createInitiation() (*initiation, error) {
+	c.paceInitiation()
+
+	initiation := &initiation{client: c}
+	handshake := &initiation.handshake
+	handshake.chainKey = blake2s.Sum256([]byte(NoiseConstruction))
+	mixHash(&handshake.hash, &handshake.chainKey, []byte(WGIdentifier))
+
+	initiation.privateKey = c.privateKey
+	publicKey := c.publicKey
+	handshake.presharedKey = c.presharedKey
+
+	cookieGenerator := &initiation.cookieGenerator
+	c.cookie(cookieGenerator)
+	handshake.precomputedStaticStatic = c.precomputedStaticStatic
+	handshake.remoteStatic = c.peerPublicKey
+
+	var err error
+	handshake.localEphemeral, err = newPrivateKey(c.random)
 	if err != nil {
-		return nil, nil, err
+		return nil, err
 	}
 
 	handshake.mixHash(handshake.remoteStatic[:])
@@ -109,7 +210,7 @@ func handshake(config Configuration) (*Keypair, net.Conn, error) {
 
 	ss := handshake.localEphemeral.sharedSecret(handshake.remoteStatic)
 	if isZero(ss[:]) {
-		return nil, nil, err
+		return nil, ErrInvalidPublicKey
 	}
 
 	var key1 [chacha20poly1305.KeySize]byte
@@ -124,10 +225,6 @@ func handshake(config Configuration) (*Keypair, net.Conn, error) {
 	aead.Seal(msg.Static[:0], ZeroNonce[:], publicKey[:], handshake.hash[:])
 	handshake.mixHash(msg.Static[:])
 
-	if isZero(handshake.precomputedStaticStatic[:]) {
-		return nil, nil, err
-	}
-
 	kdf2(
 		&handshake.chainKey,
 		&key1,
@@ -135,11 +232,14 @@ func handshake(config Configuration) (*Keypair, net.Conn, error) {
 		handshake.precomputedStaticStatic[:],
 	)
 
-	timestamp := stamp(time.Now())
+	timestamp := stamp(c.now())
 	aead, _ = chacha20poly1305.New(key1[:])
 	aead.Seal(msg.Timestamp[:0], ZeroNonce[:], timestamp[:], handshake.hash[:])
 
-	msg.Sender = randUint32()
+	msg.Sender, err = randUint32(c.random)
+	if err != nil {
+		return nil, err
+	}
 	handshake.localIndex = msg.Sender
 
 	handshake.mixHash(msg.Timestamp[:])
@@ -147,30 +247,50 @@ func handshake(config Configuration) (*Keypair, net.Conn, error) {
 	var buff [MessageInitiationSize]byte
 	writer := bytes.NewBuffer(buff[:0])
 	binary.Write(writer, binary.LittleEndian, msg)
-	packet := writer.Bytes()
-	cookieGenerator.addMacs(packet)
+	initiation.packet = writer.Bytes()
+	cookieGenerator.addMacs(initiation.packet)
 
-	conn, err := net.Dial("udp4", config.Endpoint)
-    if err != nil {
-		return nil, nil, err
-    }
+	return initiation, nil
+}
 
-    _, err = conn.Write(packet)
-    if err != nil {
-        return nil, nil, err
-    }
+// consumeCookieReply adds the cookie of a reply to the initiation, which then
+// has to be sent again.
+func (i *initiation) consumeCookieReply(packet []byte) bool {
+	if len(packet) != MessageCookieReplySize {
+		return false
+	}
 
-    buffer := make([]byte, UdpRecieveSize)
-    length, err := conn.Read(buffer)
-    if err != nil {
-        return nil, nil, err
-    }
+	var reply MessageCookieReply
+	reader := bytes.NewReader(packet)
+	err := binary.Read(reader, binary.LittleEndian, &reply)
+	if err != nil || reply.Receiver != i.handshake.localIndex {
+		return false
+	}
+
+	if !i.cookieGenerator.consumeReply(&reply) {
+		return false
+	}
+	i.client.setCookie(&i.cookieGenerator)
+	i.cookieGenerator.addMacs(i.packet)
+	return true
+}
+
+func (i *initiation) consumeResponse(packet []byte) (*Keypair, error) {
+	handshake := &i.handshake
+
+	if len(packet) != MessageResponseSize {
+		return nil, ErrInvalidPacket
+	}
 
 	var response MessageResponse
-	reader := bytes.NewReader(buffer[:length])
-	err = binary.Read(reader, binary.LittleEndian, &response)
+	reader := bytes.NewReader(packet)
+	err := binary.Read(reader, binary.LittleEndian, &response)
 	if err != nil {
-		return nil, nil, err
+		return nil, err
+	}
+
+	if response.Type != MessageResponseType || response.Receiver != handshake.localIndex {
+		return nil, ErrInvalidPacket
 	}
 
 	var (
@@ -182,10 +302,13 @@ func handshake(config Configuration) (*Keypair, net.Conn, error) {
 	mixKey(&chainKey, &handshake.chainKey, response.Ephemeral[:])
 
 	ss1 := handshake.localEphemeral.sharedSecret(response.Ephemeral)
+	if isZero(ss1[:]) {
+		return nil, ErrInvalidPacket
+	}
 	mixKey(&chainKey, &chainKey, ss1[:])
 	setZero(ss1[:])
 
-	ss2 := privateKey.sharedSecret(response.Ephemeral)
+	ss2 := i.privateKey.sharedSecret(response.Ephemeral)
 	mixKey(&chainKey, &chainKey, ss2[:])
 	setZero(ss2[:])
 
@@ -203,7 +326,7 @@ func handshake(config Configuration) (*Keypair, net.Conn, error) {
 	aead1, _ := chacha20poly1305.New(key2[:])
 	_, err = aead1.Open(nil, ZeroNonce[:], response.Empty[:], hash[:])
 	if err != nil {
-		return nil, nil, err
+		return nil, err
 	}
 	mixHash(&hash, &hash, response.Empty[:])
 
@@ -227,19 +350,183 @@ func handshake(config Configuration) (*Keypair, net.Conn, error) {
 	setZero(handshake.chainKey[:])
 	setZero(handshake.hash[:])
 	setZero(handshake.localEphemeral[:])
+	setZero(i.privateKey[:])
 
-	keypair := new(Keypair)
-	keypair.send, _ = chacha20poly1305.New(sendKey[:])
-	keypair.receive, _ = chacha20poly1305.New(recvKey[:])
+	keypair := newKeypair(sendKey, recvKey)
 
 	setZero(sendKey[:])
 	setZero(recvKey[:])
 
-	keypair.created = time.Now()
+	keypair.created = i.client.now()
+	keypair.isInitiator = true
 	keypair.localIndex = handshake.localIndex
 	keypair.remoteIndex = handshake.remoteIndex
 
-	return keypair, conn, nil
+	return keypair, nil
+}
+
+// receivedInitiation is an initiation from a peer that we are responding to.
+type receivedInitiation struct {
+	handshake       Handshake
+	sender          uint32
+	remoteEphemeral NoisePublicKey
+	timestamp       Timestamp
+}
+
+// consumeInitiation decrypts an initiation sent to privateKey. The MACs are
+// checked by the caller; the peer still has to be looked up by remoteStatic.
+func consumeInitiation(packet []byte, privateKey *NoisePrivateKey) (*receivedInitiation, error) {
+	if len(packet) != MessageInitiationSize {
+		return nil, ErrInvalidPacket
+	}
+
+	var msg MessageInitiation
+	reader := bytes.NewReader(packet)
+	err := binary.Read(reader, binary.LittleEndian, &msg)
+	if err != nil {
+		return nil, err
+	}
+
+	if msg.Type != MessageInitiationType {
+		return nil, ErrInvalidPacket
+	}
+
+	received := &receivedInitiation{
+		sender:          msg.Sender,
+		remoteEphemeral: msg.Ephemeral,
+	}
+	handshake := &received.handshake
+	handshake.chainKey = blake2s.Sum256([]byte(NoiseConstruction))
+	mixHash(&handshake.hash, &handshake.chainKey, []byte(WGIdentifier))
+
+	publicKey := privateKey.publicKey()
+	handshake.mixHash(publicKey[:])
+	handshake.mixHash(msg.Ephemeral[:])
+	handshake.mixKey(msg.Ephemeral[:])
+
+	ss := privateKey.sharedSecret(msg.Ephemeral)
+	if isZero(ss[:]) {
+		return nil, ErrInvalidPacket
+	}
+
+	var key [chacha20poly1305.KeySize]byte
+	kdf2(
+		&handshake.chainKey,
+		&key,
+		handshake.chainKey[:],
+		ss[:],
+	)
+
+	aead, _ := chacha20poly1305.New(key[:])
+	_, err = aead.Open(handshake.remoteStatic[:0], ZeroNonce[:], msg.Static[:], handshake.hash[:])
+	if err != nil {
+		return nil, err
+	}
+	handshake.mixHash(msg.Static[:])
+
+	handshake.precomputedStaticStatic = privateKey.sharedSecret(handshake.remoteStatic)
+	if isZero(handshake.precomputedStaticStatic[:]) {
+		return nil, ErrInvalidPublicKey
+	}
+
+	kdf2(
+		&handshake.chainKey,
+		&key,
+		handshake.chainKey[:],
+		handshake.precomputedStaticStatic[:],
+	)
+
+	aead, _ = chacha20poly1305.New(key[:])
+	_, err = aead.Open(received.timestamp[:0], ZeroNonce[:], msg.Timestamp[:], handshake.hash[:])
+	if err != nil {
+		return nil, err
+	}
+	handshake.mixHash(msg.Timestamp[:])
+
+	handshake.remoteIndex = msg.Sender
+	return received, nil
+}
+
+// createResponse completes the handshake as the responder. The keypair must
+// not be sent with before the initiator has used it.
+func (r *receivedInitiation) createResponse(random io.Reader, now func() time.Time) (*Keypair, []byte, error) {
+	handshake := &r.handshake
+
+	var err error
+	handshake.localEphemeral, err = newPrivateKey(random)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	msg := MessageResponse{
+		Type:      MessageResponseType,
+		Receiver:  r.sender,
+		Ephemeral: handshake.localEphemeral.publicKey(),
+	}
+
+	handshake.mixHash(msg.Ephemeral[:])
+	handshake.mixKey(msg.Ephemeral[:])
+
+	ss := handshake.localEphemeral.sharedSecret(r.remoteEphemeral)
+	handshake.mixKey(ss[:])
+	ss = handshake.localEphemeral.sharedSecret(handshake.remoteStatic)
+	handshake.mixKey(ss[:])
+	setZero(ss[:])
+
+	var tau [blake2s.Size]byte
+	var key [chacha20poly1305.KeySize]byte
+	kdf3(
+		&handshake.chainKey,
+		&tau,
+		&key,
+		handshake.chainKey[:],
+		handshake.presharedKey[:],
+	)
+	handshake.mixHash(tau[:])
+
+	aead, _ := chacha20poly1305.New(key[:])
+	aead.Seal(msg.Empty[:0], ZeroNonce[:], nil, handshake.hash[:])
+	handshake.mixHash(msg.Empty[:])
+
+	msg.Sender, err = randUint32(random)
+	if err != nil {
+		return nil, nil, err
+	}
+	handshake.localIndex = msg.Sender
+
+	var buff [MessageResponseSize]byte
+	writer := bytes.NewBuffer(buff[:0])
+	binary.Write(writer, binary.LittleEndian, msg)
+	packet := writer.Bytes()
+
+	cookieGenerator := new(CookieGenerator)
+	cookieGenerator.init(handshake.remoteStatic, now)
+	cookieGenerator.addMacs(packet)
+
+	var sendKey [chacha20poly1305.KeySize]byte
+	var recvKey [chacha20poly1305.KeySize]byte
+
+	kdf2(
+		&recvKey,
+		&sendKey,
+		handshake.chainKey[:],
+		nil,
+	)
+
+	setZero(handshake.chainKey[:])
+	setZero(handshake.hash[:])
+	setZero(handshake.localEphemeral[:])
+
+	keypair := newKeypair(sendKey, recvKey)
+
+	setZero(sendKey[:])
+	setZero(recvKey[:])
+
+	keypair.created = now()
+	keypair.localIndex = handshake.localIndex
+	keypair.remoteIndex = handshake.remoteIndex
+
+	return keypair, packet, nil
 }
 
 func (h *Handshake) mixHash(data []byte) {
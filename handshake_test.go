@@ -0,0 +1,146 @@
+package wireguard
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"testing"
+	"time"
+)
+
+// counterReader yields 0, 1, 2, ... in place of random bytes.
+type counterReader struct {
+	next byte
+}
+
+func (r *counterReader) Read(b []byte) (int, error) {
+	for i := range b {
+		b[i] = r.next
+		r.next++
+	}
+	return len(b), nil
+}
+
+// fixedNow is the clock the vectors were made with.
+func fixedNow() time.Time {
+	return time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+}
+
+func testKey(seed byte) (privateKey NoisePrivateKey, encoded string) {
+	for i := range privateKey {
+		privateKey[i] = seed + byte(i)*3
+	}
+	privateKey.clamp()
+	return privateKey, base64.StdEncoding.EncodeToString(privateKey[:])
+}
+
+func testPublicKey(privateKey NoisePrivateKey) string {
+	publicKey := privateKey.publicKey()
+	return base64.StdEncoding.EncodeToString(publicKey[:])
+}
+
+func checkHex(t *testing.T, name string, got []byte, want string) {
+	t.Helper()
+	if hex.EncodeToString(got) != want {
+		t.Errorf("%s =\n%x\nwant\n%s", name, got, want)
+	}
+}
+
+// Golden vectors for the keys from testKey, counterReader randomness and the
+// fixed clock; regenerate them only for a deliberate change to the wire format.
+const (
+	goldenInitiation = "01000000202122238f40c5adb68f25624ae5b214ea767a6ec94d829d3d7b5e1ad1ba6f3e2138285fafd69b34afd12647e3bab8d8698de3f3647d1cfddf1b9aae84a6c9f4dee02fbadfcb2fb1dbb8bb4f2c588e193fadb106a45e471c673c51ccbda31f1cebb1dfa28617f27fc8327177420155ebd71100b28e445911f33d6aec16f4f3c300000000000000000000000000000000"
+	goldenResponse   = "020000004445464720212223f7161ac20bf80c387f05ca17363bfb96146d62e53b7786773b6b32b93ccf5e09c9624f17148ac71013fcc3f78e8785006f95e6dce83d36bdd1d6e4a05b7b2a4b00000000000000000000000000000000"
+	goldenSendKey    = "a9313fe62da0d3b05451edc82d301d0798d8990ccb1ec92bce9cdf6cadc9ab1b"
+	goldenReceiveKey = "884bd8e9c160b56a91693987e363839b9118955cc501e3f1c539f0089a4b2e68"
+	goldenMAC1       = "b64de957e2cea7b3c043c3002f87aade"
+	goldenMAC2       = "885a3d451f754c0f7a70c00cb2996391"
+)
+
+func TestHandshakeVectors(t *testing.T) {
+	// both sides draw from the same reader, one after the other
+	random := &counterReader{}
+
+	_, clientEncoded := testKey(1)
+	serverPrivateKey, _ := testKey(101)
+	config := Configuration{
+		PrivateKey:   clientEncoded,
+		PublicKey:    testPublicKey(serverPrivateKey),
+		PresharedKey: base64.StdEncoding.EncodeToString(make([]byte, NoisePresharedKeySize)),
+		Rand:         random,
+		Now:          fixedNow,
+	}
+
+	client, err := NewClient(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	initiation, err := client.createInitiation()
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkHex(t, "initiation", initiation.packet, goldenInitiation)
+
+	received, err := consumeInitiation(initiation.packet, &serverPrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if received.timestamp != stamp(fixedNow()) {
+		t.Errorf("timestamp = %x, want %x", received.timestamp, stamp(fixedNow()))
+	}
+
+	responderKeypair, response, err := received.createResponse(random, fixedNow)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkHex(t, "response", response, goldenResponse)
+
+	keypair, err := initiation.consumeResponse(response)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkHex(t, "send key", keypair.sendKey[:], goldenSendKey)
+	checkHex(t, "receive key", keypair.receiveKey[:], goldenReceiveKey)
+
+	if keypair.sendKey != responderKeypair.receiveKey || keypair.receiveKey != responderKeypair.sendKey {
+		t.Error("initiator and responder derived different keys")
+	}
+	if keypair.remoteIndex != responderKeypair.localIndex || keypair.localIndex != responderKeypair.remoteIndex {
+		t.Error("initiator and responder disagree on the indices")
+	}
+}
+
+func TestCookieGeneratorVectors(t *testing.T) {
+	serverPrivateKey, _ := testKey(101)
+	message := make([]byte, MessageInitiationSize)
+	for i := range message {
+		message[i] = byte(i)
+	}
+
+	var generator CookieGenerator
+	generator.init(serverPrivateKey.publicKey(), fixedNow)
+
+	// no cookie yet: mac2 stays zero
+	generator.addMacs(message)
+	mac1 := message[len(message)-32 : len(message)-16]
+	mac2 := message[len(message)-16:]
+	checkHex(t, "mac1", mac1, goldenMAC1)
+	checkHex(t, "mac2 without cookie", mac2, "00000000000000000000000000000000")
+
+	var checker CookieChecker
+	checker.init(serverPrivateKey.publicKey())
+	if !checker.checkMAC1(message) {
+		t.Error("checkMAC1 rejected the generated mac1")
+	}
+
+	for i := range generator.mac2.cookie {
+		generator.mac2.cookie[i] = byte(0xc0 + i)
+	}
+	generator.mac2.cookieSet = fixedNow()
+	generator.addMacs(message)
+	checkHex(t, "mac1 with cookie", mac1, goldenMAC1)
+	checkHex(t, "mac2", mac2, goldenMAC2)
+
+	generator.mac2.cookieSet = fixedNow().Add(-CookieRefreshTime - time.Second)
+	generator.addMacs(message)
+	checkHex(t, "mac2 with an expired cookie", mac2, "00000000000000000000000000000000")
+}
@@ -0,0 +1,408 @@
+package format
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+)
+
+// Only the subset of CBOR (RFC 8949) that maps onto JSON is supported.
+
+const (
+	cborUnsigned = 0 << 5
+	cborNegative = 1 << 5
+	cborBytes    = 2 << 5
+	cborText     = 3 << 5
+	cborArray    = 4 << 5
+	cborMap      = 5 << 5
+	cborTag      = 6 << 5
+	cborSimple   = 7 << 5
+
+	cborFalse     = cborSimple | 20
+	cborTrue      = cborSimple | 21
+	cborNull      = cborSimple | 22
+	cborUndefined = cborSimple | 23
+	cborFloat16   = cborSimple | 25
+	cborFloat32   = cborSimple | 26
+	cborFloat64   = cborSimple | 27
+	cborBreak     = cborSimple | 31
+
+	cborIndefinite = 31
+	cborMaxDepth   = 64
+)
+
+var errInvalidCBOR = errors.New("invalid CBOR")
+
+func jsonToCBOR(data []byte) ([]byte, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+
+	var value interface{}
+	err := decoder.Decode(&value)
+	if err != nil {
+		return nil, err
+	}
+	if decoder.More() {
+		return nil, fmt.Errorf("unexpected data after JSON value")
+	}
+
+	var buffer bytes.Buffer
+	err = encodeCBOR(&buffer, value)
+	if err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+func encodeCBOR(buffer *bytes.Buffer, value interface{}) error {
+	switch v := value.(type) {
+	case nil:
+		buffer.WriteByte(cborNull)
+	case bool:
+		if v {
+			buffer.WriteByte(cborTrue)
+		} else {
+			buffer.WriteByte(cborFalse)
+		}
+	case json.Number:
+		if i, err := strconv.ParseInt(string(v), 10, 64); err == nil {
+			if i >= 0 {
+				writeCBORHead(buffer, cborUnsigned, uint64(i))
+			} else {
+				writeCBORHead(buffer, cborNegative, uint64(-1-i))
+			}
+			return nil
+		}
+		if u, err := strconv.ParseUint(string(v), 10, 64); err == nil {
+			writeCBORHead(buffer, cborUnsigned, u)
+			return nil
+		}
+		f, err := v.Float64()
+		if err != nil {
+			return err
+		}
+		buffer.WriteByte(cborFloat64)
+		binary.Write(buffer, binary.BigEndian, math.Float64bits(f))
+	case string:
+		writeCBORHead(buffer, cborText, uint64(len(v)))
+		buffer.WriteString(v)
+	case []interface{}:
+		writeCBORHead(buffer, cborArray, uint64(len(v)))
+		for _, item := range v {
+			err := encodeCBOR(buffer, item)
+			if err != nil {
+				return err
+			}
+		}
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		writeCBORHead(buffer, cborMap, uint64(len(v)))
+		for _, key := range keys {
+			writeCBORHead(buffer, cborText, uint64(len(key)))
+			buffer.WriteString(key)
+			err := encodeCBOR(buffer, v[key])
+			if err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("unsupported JSON value %T", value)
+	}
+	return nil
+}
+
+func writeCBORHead(buffer *bytes.Buffer, major byte, n uint64) {
+	switch {
+	case n < 24:
+		buffer.WriteByte(major | byte(n))
+	case n <= math.MaxUint8:
+		buffer.WriteByte(major | 24)
+		buffer.WriteByte(byte(n))
+	case n <= math.MaxUint16:
+		buffer.WriteByte(major | 25)
+		binary.Write(buffer, binary.BigEndian, uint16(n))
+	case n <= math.MaxUint32:
+		buffer.WriteByte(major | 26)
+		binary.Write(buffer, binary.BigEndian, uint32(n))
+	default:
+		buffer.WriteByte(major | 27)
+		binary.Write(buffer, binary.BigEndian, n)
+	}
+}
+
+func cborToJSON(data []byte) ([]byte, error) {
+	decoder := &cborDecoder{data: data}
+	value, err := decoder.decode(0)
+	if err != nil {
+		return nil, err
+	}
+	if decoder.offset != len(data) {
+		return nil, fmt.Errorf("%w: unexpected data after CBOR item", errInvalidCBOR)
+	}
+	return json.Marshal(value)
+}
+
+type cborDecoder struct {
+	data   []byte
+	offset int
+}
+
+func (d *cborDecoder) decode(depth int) (interface{}, error) {
+	if depth > cborMaxDepth {
+		return nil, fmt.Errorf("%w: nested too deeply", errInvalidCBOR)
+	}
+
+	initial, err := d.next(1)
+	if err != nil {
+		return nil, err
+	}
+	major := initial[0] & 0xe0
+	info := initial[0] & 0x1f
+
+	if major == cborSimple {
+		return d.decodeSimple(initial[0])
+	}
+
+	if info == cborIndefinite {
+		return d.decodeIndefinite(major, depth)
+	}
+
+	n, err := d.argument(info)
+	if err != nil {
+		return nil, err
+	}
+
+	switch major {
+	case cborUnsigned:
+		return n, nil
+	case cborNegative:
+		if n > math.MaxInt64 {
+			return -1 - float64(n), nil
+		}
+		return -1 - int64(n), nil
+	case cborBytes:
+		b, err := d.next(n)
+		if err != nil {
+			return nil, err
+		}
+		return base64.StdEncoding.EncodeToString(b), nil
+	case cborText:
+		b, err := d.next(n)
+		if err != nil {
+			return nil, err
+		}
+		return string(b), nil
+	case cborArray:
+		// every item takes at least one byte
+		if n > uint64(len(d.data)-d.offset) {
+			return nil, fmt.Errorf("%w: truncated", errInvalidCBOR)
+		}
+		array := make([]interface{}, 0, n)
+		for i := uint64(0); i < n; i++ {
+			item, err := d.decode(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			array = append(array, item)
+		}
+		return array, nil
+	case cborMap:
+		if n > uint64(len(d.data)-d.offset)/2 {
+			return nil, fmt.Errorf("%w: truncated", errInvalidCBOR)
+		}
+		object := make(map[string]interface{}, n)
+		for i := uint64(0); i < n; i++ {
+			err := d.decodeEntry(object, depth)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return object, nil
+	default:
+		// tags are dropped, the tagged item is kept
+		return d.decode(depth + 1)
+	}
+}
+
+func (d *cborDecoder) decodeIndefinite(major byte, depth int) (interface{}, error) {
+	switch major {
+	case cborBytes, cborText:
+		var buffer bytes.Buffer
+		for !d.atBreak() {
+			if d.offset >= len(d.data) || d.data[d.offset]&0xe0 != major || d.data[d.offset]&0x1f == cborIndefinite {
+				return nil, fmt.Errorf("%w: invalid string chunk", errInvalidCBOR)
+			}
+			chunk, err := d.decode(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			s := chunk.(string)
+			if major == cborBytes {
+				b, _ := base64.StdEncoding.DecodeString(s)
+				buffer.Write(b)
+			} else {
+				buffer.WriteString(s)
+			}
+		}
+		if major == cborBytes {
+			return base64.StdEncoding.EncodeToString(buffer.Bytes()), nil
+		}
+		return buffer.String(), nil
+	case cborArray:
+		array := []interface{}{}
+		for !d.atBreak() {
+			item, err := d.decode(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			array = append(array, item)
+		}
+		return array, nil
+	case cborMap:
+		object := map[string]interface{}{}
+		for !d.atBreak() {
+			err := d.decodeEntry(object, depth)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return object, nil
+	default:
+		return nil, fmt.Errorf("%w: unexpected indefinite length", errInvalidCBOR)
+	}
+}
+
+func (d *cborDecoder) decodeEntry(object map[string]interface{}, depth int) error {
+	key, err := d.decode(depth + 1)
+	if err != nil {
+		return err
+	}
+	value, err := d.decode(depth + 1)
+	if err != nil {
+		return err
+	}
+
+	switch k := key.(type) {
+	case string:
+		object[k] = value
+	case uint64, int64, float64, bool, nil:
+		object[fmt.Sprint(k)] = value
+	default:
+		return fmt.Errorf("%w: unsupported map key", errInvalidCBOR)
+	}
+	return nil
+}
+
+func (d *cborDecoder) decodeSimple(initial byte) (interface{}, error) {
+	switch initial {
+	case cborFalse:
+		return false, nil
+	case cborTrue:
+		return true, nil
+	case cborNull, cborUndefined:
+		return nil, nil
+	case cborFloat16:
+		b, err := d.next(2)
+		if err != nil {
+			return nil, err
+		}
+		return float16(binary.BigEndian.Uint16(b)), nil
+	case cborFloat32:
+		b, err := d.next(4)
+		if err != nil {
+			return nil, err
+		}
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(b))), nil
+	case cborFloat64:
+		b, err := d.next(8)
+		if err != nil {
+			return nil, err
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(b)), nil
+	default:
+		return nil, fmt.Errorf("%w: unsupported simple value 0x%02x", errInvalidCBOR, initial)
+	}
+}
+
+func (d *cborDecoder) argument(info byte) (uint64, error) {
+	switch {
+	case info < 24:
+		return uint64(info), nil
+	case info == 24:
+		b, err := d.next(1)
+		if err != nil {
+			return 0, err
+		}
+		return uint64(b[0]), nil
+	case info == 25:
+		b, err := d.next(2)
+		if err != nil {
+			return 0, err
+		}
+		return uint64(binary.BigEndian.Uint16(b)), nil
+	case info == 26:
+		b, err := d.next(4)
+		if err != nil {
+			return 0, err
+		}
+		return uint64(binary.BigEndian.Uint32(b)), nil
+	case info == 27:
+		b, err := d.next(8)
+		if err != nil {
+			return 0, err
+		}
+		return binary.BigEndian.Uint64(b), nil
+	default:
+		return 0, fmt.Errorf("%w: reserved additional information %d", errInvalidCBOR, info)
+	}
+}
+
+func (d *cborDecoder) atBreak() bool {
+	if d.offset < len(d.data) && d.data[d.offset] == cborBreak {
+		d.offset++
+		return true
+	}
+	return false
+}
+
+func (d *cborDecoder) next(n uint64) ([]byte, error) {
+	if n > uint64(len(d.data)-d.offset) {
+		return nil, fmt.Errorf("%w: truncated", errInvalidCBOR)
+	}
+	b := d.data[d.offset : d.offset+int(n)]
+	d.offset += int(n)
+	return b, nil
+}
+
+func float16(bits uint16) float64 {
+	exponent := int(bits >> 10 & 0x1f)
+	mantissa := float64(bits & 0x3ff)
+	var value float64
+	switch exponent {
+	case 0:
+		value = math.Ldexp(mantissa, -24)
+	case 0x1f:
+		if mantissa == 0 {
+			value = math.Inf(1)
+		} else {
+			value = math.NaN()
+		}
+	default:
+		value = math.Ldexp(mantissa+1024, exponent-25)
+	}
+	if bits&0x8000 != 0 {
+		return -value
+	}
+	return value
+}
@@ -0,0 +1,188 @@
+package format
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+)
+
+// Examples from RFC 8949 Appendix A, byte strings coming out as base64.
+func TestCBORToJSON(t *testing.T) {
+	tests := []struct {
+		cbor string
+		json string
+	}{
+		{"00", `0`},
+		{"17", `23`},
+		{"1818", `24`},
+		{"1903e8", `1000`},
+		{"1bffffffffffffffff", `18446744073709551615`},
+		{"20", `-1`},
+		{"3903e7", `-1000`},
+		{"3bffffffffffffffff", `-18446744073709552000`},
+		{"f90000", `0`},
+		{"f93c00", `1`},
+		{"f97bff", `65504`},
+		{"f90001", `5.960464477539063e-8`},
+		{"fa47c35000", `100000`},
+		{"fb3ff199999999999a", `1.1`},
+		{"f4", `false`},
+		{"f5", `true`},
+		{"f6", `null`},
+		{"f7", `null`},
+		{"40", `""`},
+		{"4401020304", `"AQIDBA=="`},
+		{"6449455446", `"IETF"`},
+		{"83010203", `[1,2,3]`},
+		{"a201020304", `{"1":2,"3":4}`},
+		{"a26161016162820203", `{"a":1,"b":[2,3]}`},
+		{"c074323031332d30332d32315432303a30343a30305a", `"2013-03-21T20:04:00Z"`},
+		{"5f42010243030405ff", `"AQIDBAU="`},
+		{"7f657374726561646d696e67ff", `"streaming"`},
+		{"9fff", `[]`},
+		{"9f018202039f0405ffff", `[1,[2,3],[4,5]]`},
+		{"bf61610161629f0203ffff", `{"a":1,"b":[2,3]}`},
+	}
+	for _, test := range tests {
+		data, err := hex.DecodeString(test.cbor)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := cborToJSON(data)
+		if err != nil {
+			t.Errorf("%s: %v", test.cbor, err)
+			continue
+		}
+		if string(got) != test.json {
+			t.Errorf("%s = %s, want %s", test.cbor, got, test.json)
+		}
+	}
+}
+
+func TestJSONToCBOR(t *testing.T) {
+	tests := []struct {
+		json string
+		cbor string
+	}{
+		{`0`, "00"},
+		{`23`, "17"},
+		{`24`, "1818"},
+		{`255`, "18ff"},
+		{`256`, "190100"},
+		{`65535`, "19ffff"},
+		{`65536`, "1a00010000"},
+		{`4294967295`, "1affffffff"},
+		{`4294967296`, "1b0000000100000000"},
+		{`18446744073709551615`, "1bffffffffffffffff"},
+		{`-1`, "20"},
+		{`-25`, "3818"},
+		{`1.1`, "fb3ff199999999999a"},
+		{`1e300`, "fb7e37e43c8800759c"},
+		{`"IETF"`, "6449455446"},
+		{`[]`, "80"},
+		{`{"b":1,"a":[true,false,null]}`, "a2616183f5f4f6616201"},
+	}
+	for _, test := range tests {
+		got, err := jsonToCBOR([]byte(test.json))
+		if err != nil {
+			t.Errorf("%s: %v", test.json, err)
+			continue
+		}
+		if hex.EncodeToString(got) != test.cbor {
+			t.Errorf("%s = %x, want %s", test.json, got, test.cbor)
+		}
+	}
+}
+
+func TestCBORMalformed(t *testing.T) {
+	tests := []struct {
+		name string
+		cbor string
+	}{
+		{"empty", ""},
+		{"truncated argument", "19 01"},
+		{"truncated float", "fb 3ff1"},
+		{"truncated text", "62 61"},
+		{"truncated array", "83 01 02"},
+		{"truncated map", "a1 01"},
+		{"huge array", "9b ffffffffffffffff"},
+		{"huge map", "bb ffffffffffffffff"},
+		{"huge text", "7b ffffffffffffffff"},
+		{"text chunk in byte string", "5f 6161 ff"},
+		{"byte chunk in text string", "7f 4161 ff"},
+		{"indefinite chunk", "5f 5f ff ff"},
+		{"non-string chunk", "7f 01 ff"},
+		{"unterminated chunks", "7f 6161"},
+		{"unterminated array", "9f 01"},
+		{"unterminated map", "bf 6161 01"},
+		{"indefinite integer", "1f"},
+		{"indefinite tag", "df 00"},
+		{"reserved argument", "1c"},
+		{"simple value", "f8 20"},
+		{"lone break", "ff"},
+		{"array key", "a1 80 01"},
+		{"trailing data", "01 01"},
+		{"nested arrays", strings.Repeat("81", cborMaxDepth+1) + "00"},
+		{"nested indefinite arrays", strings.Repeat("9f", cborMaxDepth+1)},
+		{"nested maps", strings.Repeat("a1 00", cborMaxDepth+1) + "00"},
+		{"nested tags", strings.Repeat("c1", cborMaxDepth+1) + "00"},
+	}
+	for _, test := range tests {
+		data, err := hex.DecodeString(strings.ReplaceAll(test.cbor, " ", ""))
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = cborToJSON(data)
+		if !errors.Is(err, errInvalidCBOR) {
+			t.Errorf("%s: err = %v, want errInvalidCBOR", test.name, err)
+		}
+	}
+}
+
+func TestCBORNestingLimit(t *testing.T) {
+	data, _ := hex.DecodeString(strings.Repeat("81", cborMaxDepth) + "00")
+	_, err := cborToJSON(data)
+	if err != nil {
+		t.Errorf("%d nested arrays: %v", cborMaxDepth, err)
+	}
+}
+
+// Run with
+//
+//	go test -fuzz FuzzCBORToJSON ./internal/format
+func FuzzCBORToJSON(f *testing.F) {
+	for _, seed := range []string{"a26161016162820203", "bf61610161629f0203ffff", "5f42010243030405ff", "c074323031332d30332d32315432303a30343a30305a", "f97bff", "3bffffffffffffffff"} {
+		data, _ := hex.DecodeString(seed)
+		f.Add(data)
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		converted, err := cborToJSON(data)
+		if err != nil {
+			return
+		}
+		if !json.Valid(converted) {
+			t.Fatalf("%x gave invalid JSON %s", data, converted)
+		}
+
+		// the JSON we give out goes back to CBOR, and from then on nothing changes
+		encoded, err := jsonToCBOR(converted)
+		if err != nil {
+			t.Fatalf("%s: %v", converted, err)
+		}
+		again, err := cborToJSON(encoded)
+		if err != nil {
+			t.Fatalf("%x: %v", encoded, err)
+		}
+		encodedAgain, err := jsonToCBOR(again)
+		if err != nil {
+			t.Fatalf("%s: %v", again, err)
+		}
+		if !bytes.Equal(encoded, encodedAgain) {
+			t.Fatalf("%s encoded as %x, then %x", converted, encoded, encodedAgain)
+		}
+	})
+}
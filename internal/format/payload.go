@@ -0,0 +1,90 @@
+package format
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+const (
+	Text      = "text"
+	Base64    = "base64"
+	Base64URL = "base64url"
+	Hex       = "hex"
+	JSON      = "json"
+	CBOR      = "cbor" // JSON on the command line, CBOR on the wire
+)
+
+var Formats = []string{Text, Base64, Base64URL, Hex, JSON, CBOR}
+
+func Valid(format string) bool {
+	if format == "" {
+		return true
+	}
+	for _, f := range Formats {
+		if f == format {
+			return true
+		}
+	}
+	return false
+}
+
+// Decode converts a payload written in format into the bytes to send.
+// An empty format means text.
+func Decode(format string, s string) ([]byte, error) {
+	switch format {
+	case "", Text:
+		return []byte(s), nil
+	case Base64:
+		return base64.StdEncoding.DecodeString(strings.TrimSpace(s))
+	case Base64URL:
+		return base64.RawURLEncoding.DecodeString(strings.TrimRight(strings.TrimSpace(s), "="))
+	case Hex:
+		return hex.DecodeString(strings.Join(strings.Fields(s), ""))
+	case JSON:
+		var buffer bytes.Buffer
+		err := json.Compact(&buffer, []byte(s))
+		if err != nil {
+			return nil, err
+		}
+		return buffer.Bytes(), nil
+	case CBOR:
+		return jsonToCBOR([]byte(s))
+	default:
+		return nil, unknownFormat(format)
+	}
+}
+
+// Encode converts received bytes into format. An empty format means text.
+func Encode(format string, b []byte) (string, error) {
+	switch format {
+	case "", Text:
+		return string(b), nil
+	case Base64:
+		return base64.StdEncoding.EncodeToString(b), nil
+	case Base64URL:
+		return base64.RawURLEncoding.EncodeToString(b), nil
+	case Hex:
+		return hex.EncodeToString(b), nil
+	case JSON:
+		if !json.Valid(b) {
+			return "", fmt.Errorf("response is not valid JSON")
+		}
+		return string(b), nil
+	case CBOR:
+		converted, err := cborToJSON(b)
+		if err != nil {
+			return "", err
+		}
+		return string(converted), nil
+	default:
+		return "", unknownFormat(format)
+	}
+}
+
+func unknownFormat(format string) error {
+	return fmt.Errorf("unknown format %q (%s)", format, strings.Join(Formats, ", "))
+}
@@ -0,0 +1,132 @@
+package format
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestDecode(t *testing.T) {
+	tests := []struct {
+		format string
+		in     string
+		want   []byte
+	}{
+		{"", "hello", []byte("hello")},
+		{Text, "hello", []byte("hello")},
+		{Base64, " aGVsbG8=\n", []byte("hello")},
+		{Base64URL, "-_-_", []byte{0xfb, 0xff, 0xbf}},
+		{Base64URL, "-_8=", []byte{0xfb, 0xff}},
+		{Hex, "68 65 6c\n6c 6f", []byte("hello")},
+		{JSON, "{ \"a\" : [1, 2] }\n", []byte(`{"a":[1,2]}`)},
+		{CBOR, `{"a":[1,-2,"x",true,null,1.5]}`, []byte{0xa1, 0x61, 'a', 0x86, 0x01, 0x21, 0x61, 'x', 0xf5, 0xf6, 0xfb, 0x3f, 0xf8, 0, 0, 0, 0, 0, 0}},
+	}
+	for _, test := range tests {
+		got, err := Decode(test.format, test.in)
+		if err != nil {
+			t.Errorf("Decode(%q, %q): %v", test.format, test.in, err)
+			continue
+		}
+		if !bytes.Equal(got, test.want) {
+			t.Errorf("Decode(%q, %q) = %x, want %x", test.format, test.in, got, test.want)
+		}
+	}
+}
+
+func TestDecodeInvalid(t *testing.T) {
+	tests := []struct {
+		format string
+		in     string
+	}{
+		{Base64, "aGVsbG8"},
+		{Base64URL, "+/+/"},
+		{Hex, "6"},
+		{Hex, "zz"},
+		{JSON, "{"},
+		{CBOR, "{"},
+		{CBOR, "1 2"},
+		{"xml", "<a/>"},
+	}
+	for _, test := range tests {
+		_, err := Decode(test.format, test.in)
+		if err == nil {
+			t.Errorf("Decode(%q, %q) succeeded", test.format, test.in)
+		}
+	}
+}
+
+func TestEncode(t *testing.T) {
+	tests := []struct {
+		format string
+		in     []byte
+		want   string
+	}{
+		{"", []byte("hello"), "hello"},
+		{Text, []byte("hello"), "hello"},
+		{Base64, []byte("hello"), "aGVsbG8="},
+		{Base64URL, []byte{0xfb, 0xff}, "-_8"},
+		{Hex, []byte("hello"), "68656c6c6f"},
+		{JSON, []byte(`{"a": 1}`), `{"a": 1}`},
+		{CBOR, []byte{0xa1, 0x61, 'a', 0x82, 0x01, 0x21}, `{"a":[1,-2]}`},
+	}
+	for _, test := range tests {
+		got, err := Encode(test.format, test.in)
+		if err != nil {
+			t.Errorf("Encode(%q, %x): %v", test.format, test.in, err)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("Encode(%q, %x) = %q, want %q", test.format, test.in, got, test.want)
+		}
+	}
+
+	for _, format := range []string{JSON, CBOR, "xml"} {
+		_, err := Encode(format, []byte("{"))
+		if err == nil {
+			t.Errorf("Encode(%q, %q) succeeded", format, "{")
+		}
+	}
+}
+
+// Every format gives back what it was given.
+func TestRoundTrip(t *testing.T) {
+	payload := []byte{0x00, 0x01, 0xfe, 0xff, 'a'}
+	for _, format := range []string{Text, Base64, Base64URL, Hex} {
+		encoded, err := Encode(format, payload)
+		if err != nil {
+			t.Fatal(err)
+		}
+		decoded, err := Decode(format, encoded)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(decoded, payload) {
+			t.Errorf("%s: %x, want %x", format, decoded, payload)
+		}
+	}
+
+	document := `{"a":[1,-2,1.5,"x",true,false,null],"b":{"c":18446744073709551615}}`
+	for _, format := range []string{JSON, CBOR} {
+		decoded, err := Decode(format, document)
+		if err != nil {
+			t.Fatal(err)
+		}
+		encoded, err := Encode(format, decoded)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if encoded != document {
+			t.Errorf("%s: %s, want %s", format, encoded, document)
+		}
+	}
+}
+
+func TestValid(t *testing.T) {
+	for _, format := range append(Formats, "") {
+		if !Valid(format) {
+			t.Errorf("Valid(%q) = false", format)
+		}
+	}
+	if Valid("xml") {
+		t.Error(`Valid("xml") = true`)
+	}
+}
@@ -0,0 +1,173 @@
+package profile
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Environment variable overriding the path of the profiles file.
+const FileEnv = "WG_PROFILES_FILE"
+
+type Profile struct {
+	PrivateKey      string `json:"privateKey"`
+	PublicKey       string `json:"publicKey"`
+	Endpoint        string `json:"endpoint"`
+	ClientIpAddress string `json:"clientIpAddress"`
+}
+
+type Store struct {
+	Profiles map[string]Profile `json:"profiles"`
+}
+
+func Load(path string) (*Store, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	store := new(Store)
+	err = json.Unmarshal(data, store)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	if store.Profiles == nil {
+		store.Profiles = make(map[string]Profile)
+	}
+	return store, nil
+}
+
+// Path returns WG_PROFILES_FILE if set, otherwise profiles.json in the user
+// configuration directory.
+func Path() (string, error) {
+	path := os.Getenv(FileEnv)
+	if path != "" {
+		return path, nil
+	}
+
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "wireguard-oneshot", "profiles.json"), nil
+}
+
+// Open is like Load but returns an empty store if the file does not exist yet.
+func Open(path string) (*Store, error) {
+	store, err := Load(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return &Store{Profiles: make(map[string]Profile)}, nil
+	}
+	return store, err
+}
+
+// Save writes the store readable by the owner only, since it holds private keys.
+func (s *Store) Save(path string) error {
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(filepath.Dir(path), 0700)
+	if err != nil {
+		return err
+	}
+
+	temp, err := ioutil.TempFile(filepath.Dir(path), ".profiles-*.json")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(temp.Name())
+
+	_, err = temp.Write(append(data, '\n'))
+	if err == nil {
+		err = temp.Chmod(0600)
+	}
+	if closeErr := temp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(temp.Name(), path)
+}
+
+func (s *Store) Names() []string {
+	names := make([]string, 0, len(s.Profiles))
+	for name := range s.Profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (s *Store) Remove(name string) error {
+	_, ok := s.Profiles[name]
+	if !ok {
+		return fmt.Errorf("profile %q not found", name)
+	}
+	delete(s.Profiles, name)
+	return nil
+}
+
+func (s *Store) Get(name string) (Profile, error) {
+	profile, ok := s.Profiles[name]
+	if !ok {
+		return Profile{}, fmt.Errorf("profile %q not found", name)
+	}
+	return profile, nil
+}
+
+// Lookup resolves a profile from WG_PROFILE_<NAME>_* environment variables,
+// falling back to the profiles file.
+func Lookup(name string) (Profile, error) {
+	profile, ok := FromEnv(name)
+	if ok {
+		return profile, nil
+	}
+
+	path, err := Path()
+	if err != nil {
+		return Profile{}, err
+	}
+
+	store, err := Open(path)
+	if err != nil {
+		return Profile{}, err
+	}
+	return store.Get(name)
+}
+
+func FromEnv(name string) (Profile, bool) {
+	prefix := EnvPrefix(name)
+	profile := Profile{
+		PrivateKey:      os.Getenv(prefix + "PRIVATE_KEY"),
+		PublicKey:       os.Getenv(prefix + "PUBLIC_KEY"),
+		Endpoint:        os.Getenv(prefix + "ENDPOINT"),
+		ClientIpAddress: os.Getenv(prefix + "CLIENT_IP_ADDRESS"),
+	}
+	return profile, profile.PrivateKey != ""
+}
+
+// EnvPrefix returns the variable prefix for a profile, e.g. "WG_PROFILE_SIM_01_"
+// for "sim-01".
+func EnvPrefix(name string) string {
+	mapped := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		default:
+			return '_'
+		}
+	}, name)
+	return "WG_PROFILE_" + mapped + "_"
+}
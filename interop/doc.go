@@ -0,0 +1,3 @@
+// Package interop tests wire compatibility with wireguard-go. It is a separate
+// module so that wireguard-go and its dependencies stay out of the library.
+package interop
@@ -0,0 +1,453 @@
+package interop
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/1stship/wireguard-oneshot"
+	"github.com/1stship/wireguard-oneshot/wgtest"
+	"golang.org/x/crypto/blake2s"
+	"golang.org/x/crypto/curve25519"
+	"golang.zx2c4.com/wireguard/conn"
+	"golang.zx2c4.com/wireguard/device"
+	"golang.zx2c4.com/wireguard/tun/netstack"
+)
+
+const (
+	peerIpv4   = "10.0.0.1"
+	peerIpv6   = "fd00::1"
+	clientIpv4 = "10.0.0.2"
+	clientIpv6 = "fd00::2"
+	echoPort   = 7
+)
+
+// peer is a wireguard-go device on a userspace network stack, answering UDP
+// on echoPort with "echo:" and the payload.
+type peer struct {
+	privateKey string
+	publicKey  string
+	endpoint   string
+	device     *device.Device
+	net        *netstack.Net
+}
+
+type peerOptions struct {
+	privateKey      string // generated when empty
+	clientPublicKey string
+	presharedKey    string
+	endpoint        string // set when the peer initiates
+	listen          bool
+}
+
+func startPeer(t *testing.T, options peerOptions) *peer {
+	t.Helper()
+
+	p := new(peer)
+	var err error
+	if options.privateKey != "" {
+		p.privateKey = options.privateKey
+		p.publicKey = publicKey(t, options.privateKey)
+	} else {
+		p.privateKey, p.publicKey, err = wgtest.GenerateKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tun, tnet, err := netstack.CreateNetTUN([]netip.Addr{netip.MustParseAddr(peerIpv4), netip.MustParseAddr(peerIpv6)}, nil, wireguard.DefaultMTU)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.net = tnet
+	p.device = device.NewDevice(tun, conn.NewDefaultBind(), device.NewLogger(device.LogLevelError, ""))
+	t.Cleanup(p.device.Close)
+
+	config := fmt.Sprintf("private_key=%s\n", hexKey(t, p.privateKey))
+	if options.listen {
+		config += "listen_port=0\n"
+	}
+	config += fmt.Sprintf("public_key=%s\n", hexKey(t, options.clientPublicKey))
+	if options.presharedKey != "" {
+		config += fmt.Sprintf("preshared_key=%s\n", hexKey(t, options.presharedKey))
+	}
+	if options.endpoint != "" {
+		config += fmt.Sprintf("endpoint=%s\n", options.endpoint)
+	}
+	config += fmt.Sprintf("allowed_ip=%s/32\nallowed_ip=%s/128\n", clientIpv4, clientIpv6)
+
+	err = p.device.IpcSet(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = p.device.Up()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if options.listen {
+		p.endpoint = fmt.Sprintf("127.0.0.1:%d", listenPort(t, p.device))
+		for _, address := range []string{peerIpv4, peerIpv6} {
+			p.echo(t, address)
+		}
+	}
+	return p
+}
+
+func (p *peer) echo(t *testing.T, address string) {
+	conn, err := p.net.ListenUDP(&net.UDPAddr{IP: net.ParseIP(address), Port: echoPort})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	go func() {
+		buffer := make([]byte, 2000)
+		for {
+			length, from, err := conn.ReadFrom(buffer)
+			if err != nil {
+				return
+			}
+			conn.WriteTo(append([]byte("echo:"), buffer[:length]...), from)
+		}
+	}()
+}
+
+func listenPort(t *testing.T, d *device.Device) int {
+	state, err := d.IpcGet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range strings.Split(state, "\n") {
+		var port int
+		if _, err := fmt.Sscanf(line, "listen_port=%d", &port); err == nil {
+			return port
+		}
+	}
+	t.Fatal("no listen_port")
+	return 0
+}
+
+func publicKey(t *testing.T, privateKey string) string {
+	raw, err := base64.StdEncoding.DecodeString(privateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	public, err := curve25519.X25519(raw, curve25519.Basepoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return base64.StdEncoding.EncodeToString(public)
+}
+
+func hexKey(t *testing.T, key string) string {
+	raw, err := base64.StdEncoding.DecodeString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return hex.EncodeToString(raw)
+}
+
+func newClient(t *testing.T) (wireguard.Configuration, string) {
+	privateKey, publicKey, err := wgtest.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := wireguard.Configuration{
+		PrivateKey:      privateKey,
+		ClientIpAddress: clientIpv4,
+		Timeout:         5 * time.Second,
+	}
+	return config, publicKey
+}
+
+func exchange(t *testing.T, tunnel *wireguard.Tunnel, payload []byte, destination string) {
+	t.Helper()
+	tunnel.SetReadDeadline(time.Now().Add(5 * time.Second))
+	response, err := tunnel.UdpOneShot(payload, destination, echoPort)
+	if err != nil {
+		t.Fatalf("%d bytes to %s: %v", len(payload), destination, err)
+	}
+	if want := append([]byte("echo:"), payload...); !bytes.Equal(response, want) {
+		t.Fatalf("%d bytes to %s: response of %d bytes, want %d", len(payload), destination, len(response), len(want))
+	}
+}
+
+func TestHandshakeAndTransport(t *testing.T) {
+	config, clientPublicKey := newClient(t)
+	p := startPeer(t, peerOptions{clientPublicKey: clientPublicKey, listen: true})
+	config.PublicKey = p.publicKey
+	config.Endpoint = p.endpoint
+
+	tunnel, err := wireguard.Dial(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tunnel.Close()
+
+	for _, size := range []int{0, 1, 15, 16, 17, 512, wireguard.MaxPayloadSize - len("echo:")} {
+		exchange(t, tunnel, bytes.Repeat([]byte{0xa5}, size), peerIpv4)
+	}
+}
+
+func TestIpv6(t *testing.T) {
+	config, clientPublicKey := newClient(t)
+	p := startPeer(t, peerOptions{clientPublicKey: clientPublicKey, listen: true})
+	config.PublicKey = p.publicKey
+	config.Endpoint = p.endpoint
+	config.ClientIpAddress = clientIpv6
+
+	tunnel, err := wireguard.Dial(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tunnel.Close()
+
+	for _, size := range []int{0, 1, 100, wireguard.MaxPayloadSize - wireguard.Ipv6HeaderSize + wireguard.IpHeaderSize - len("echo:")} {
+		exchange(t, tunnel, bytes.Repeat([]byte{0x5a}, size), peerIpv6)
+	}
+
+	err = tunnel.Send([]byte("x"), peerIpv4, echoPort)
+	if !errors.Is(err, wireguard.ErrInvalidAddress) {
+		t.Errorf("sending to IPv4 from an IPv6 address: err = %v, want ErrInvalidAddress", err)
+	}
+}
+
+func TestPresharedKey(t *testing.T) {
+	presharedKey, _, err := wgtest.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config, clientPublicKey := newClient(t)
+	p := startPeer(t, peerOptions{clientPublicKey: clientPublicKey, presharedKey: presharedKey, listen: true})
+	config.PublicKey = p.publicKey
+	config.Endpoint = p.endpoint
+
+	_, err = wireguard.Dial(config)
+	if err == nil {
+		t.Fatal("handshake without the preshared key succeeded")
+	}
+
+	// wireguard-go drops initiations from a peer coming faster than every 20ms
+	time.Sleep(50 * time.Millisecond)
+
+	config.PresharedKey = presharedKey
+	tunnel, err := wireguard.Dial(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tunnel.Close()
+
+	exchange(t, tunnel, []byte("psk"), peerIpv4)
+}
+
+// TestCookieReply puts the peer under load with a burst of initiations, so that
+// it answers ours with a cookie reply before accepting it.
+func TestCookieReply(t *testing.T) {
+	config, clientPublicKey := newClient(t)
+	p := startPeer(t, peerOptions{clientPublicKey: clientPublicKey, listen: true})
+	config.PublicKey = p.publicKey
+
+	proxy := newProxy(t, p.endpoint)
+	config.Endpoint = proxy.address
+
+	// The peer is under load for a second once an eighth of its handshake
+	// queue is waiting. Half the queue gets it there without filling the
+	// queue, which would drop our initiation.
+	flood(t, p, device.QueueHandshakeSize/2)
+
+	tunnel, err := wireguard.Dial(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tunnel.Close()
+
+	exchange(t, tunnel, []byte("cookie"), peerIpv4)
+
+	if atomic.LoadInt32(&proxy.cookieReplies) == 0 {
+		t.Error("the peer sent no cookie reply")
+	}
+}
+
+// flood sends count initiations with a valid MAC1 and garbage content, which
+// the peer has to queue and process.
+func flood(t *testing.T, p *peer, count int) {
+	conn, err := net.Dial("udp4", p.endpoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	publicKey, _ := base64.StdEncoding.DecodeString(p.publicKey)
+	hash, _ := blake2s.New256(nil)
+	hash.Write([]byte("mac1----"))
+	hash.Write(publicKey)
+	key := hash.Sum(nil)
+
+	packet := make([]byte, wireguard.MessageInitiationSize)
+	binary.LittleEndian.PutUint32(packet[0:4], wireguard.MessageInitiationType)
+	for i := 0; i < count; i++ {
+		binary.LittleEndian.PutUint32(packet[4:8], uint32(i))
+		mac, _ := blake2s.New128(key)
+		mac.Write(packet[:116])
+		mac.Sum(packet[116:116])
+		conn.Write(packet)
+	}
+}
+
+// proxy relays between a client and the peer and counts cookie replies.
+type proxy struct {
+	address       string
+	cookieReplies int32
+}
+
+func newProxy(t *testing.T, upstreamAddress string) *proxy {
+	downstream, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	upstreamUDPAddress, err := net.ResolveUDPAddr("udp4", upstreamAddress)
+	if err != nil {
+		t.Fatal(err)
+	}
+	upstream, err := net.DialUDP("udp4", nil, upstreamUDPAddress)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		downstream.Close()
+		upstream.Close()
+	})
+
+	p := &proxy{address: downstream.LocalAddr().String()}
+	client := make(chan net.Addr, 1)
+
+	go func() {
+		buffer := make([]byte, 2000)
+		var last net.Addr
+		for {
+			length, from, err := downstream.ReadFrom(buffer)
+			if err != nil {
+				return
+			}
+			if last == nil || last.String() != from.String() {
+				last = from
+				select {
+				case client <- from:
+				default:
+					<-client
+					client <- from
+				}
+			}
+			upstream.Write(buffer[:length])
+		}
+	}()
+
+	go func() {
+		buffer := make([]byte, 2000)
+		var to net.Addr
+		for {
+			length, err := upstream.Read(buffer)
+			if err != nil {
+				return
+			}
+			select {
+			case to = <-client:
+			default:
+			}
+			if length == wireguard.MessageCookieReplySize && binary.LittleEndian.Uint32(buffer[0:4]) == wireguard.MessageCookieReplyType {
+				atomic.AddInt32(&p.cookieReplies, 1)
+			}
+			if to != nil {
+				downstream.WriteTo(buffer[:length], to)
+			}
+		}
+	}()
+
+	return p
+}
+
+// TestResponder has wireguard-go initiate to a Listener.
+func TestResponder(t *testing.T) {
+	presharedKey, _, err := wgtest.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	privateKey, publicKey, err := wgtest.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	peerPrivateKey, peerPublicKey, err := wgtest.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	listener, err := wireguard.Listen(wireguard.ListenerConfiguration{
+		PrivateKey:    privateKey,
+		ListenAddress: "127.0.0.1:0",
+		IpAddress:     clientIpv4,
+		Peers:         []string{peerPublicKey},
+		PresharedKey:  presharedKey,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	go func() {
+		for {
+			tunnel, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer tunnel.Close()
+				for {
+					datagram, err := tunnel.Receive()
+					if err != nil {
+						return
+					}
+					tunnel.Reply(datagram, append([]byte("echo:"), datagram.Payload...))
+				}
+			}()
+		}
+	}()
+
+	// here the wireguard-go device is the client, sending from 10.0.0.1 to 10.0.0.2
+	p := startPeer(t, peerOptions{
+		privateKey:      peerPrivateKey,
+		clientPublicKey: publicKey,
+		presharedKey:    presharedKey,
+		endpoint:        listener.Addr().String(),
+	})
+
+	conn, err := p.net.DialUDP(nil, &net.UDPAddr{IP: net.ParseIP(clientIpv4), Port: echoPort})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	for i := 0; i < 3; i++ {
+		payload := []byte(fmt.Sprint("from wireguard-go ", i))
+		conn.Write(payload)
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		buffer := make([]byte, 2000)
+		length, err := conn.Read(buffer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := append([]byte("echo:"), payload...); !bytes.Equal(buffer[:length], want) {
+			t.Fatalf("response = %q, want %q", buffer[:length], want)
+		}
+	}
+}
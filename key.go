@@ -2,9 +2,12 @@ package wireguard
 
 import (
 	"crypto/cipher"
-	"crypto/rand"
+	"io"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"golang.org/x/crypto/chacha20poly1305"
 	"golang.org/x/crypto/curve25519"
 )
 
@@ -15,11 +18,27 @@ type (
 )
 
 type Keypair struct {
+	sendNonce    uint64
+	receiveNonce uint64 // above the highest counter received, kept for SessionState
 	send         cipher.AEAD
 	receive      cipher.AEAD
+	sendKey      [chacha20poly1305.KeySize]byte // kept for SessionState
+	receiveKey   [chacha20poly1305.KeySize]byte
 	created      time.Time
+	isInitiator  bool
 	localIndex   uint32
 	remoteIndex  uint32
+	replay       replayFilter
+}
+
+// Keypairs follows the rotation of wireguard-go: replies sent under the
+// previous keypair still decrypt after a handshake, and a keypair created as
+// the responder waits in next until the initiator has used it.
+type Keypairs struct {
+	sync.RWMutex
+	current  *Keypair
+	previous *Keypair
+	next     *Keypair
 }
 
 const (
@@ -28,8 +47,71 @@ const (
 	NoisePresharedKeySize = 32
 )
 
-func newPrivateKey() (sk NoisePrivateKey, err error) {
-	_, err = rand.Read(sk[:])
+func newKeypair(sendKey, receiveKey [chacha20poly1305.KeySize]byte) *Keypair {
+	keypair := new(Keypair)
+	keypair.send, _ = chacha20poly1305.New(sendKey[:])
+	keypair.receive, _ = chacha20poly1305.New(receiveKey[:])
+	keypair.sendKey = sendKey
+	keypair.receiveKey = receiveKey
+	return keypair
+}
+
+func (kp *Keypairs) Current() *Keypair {
+	kp.RLock()
+	defer kp.RUnlock()
+	return kp.current
+}
+
+func (kp *Keypairs) lookup(localIndex uint32) *Keypair {
+	kp.RLock()
+	defer kp.RUnlock()
+	for _, keypair := range [...]*Keypair{kp.current, kp.previous, kp.next} {
+		if keypair != nil && keypair.localIndex == localIndex {
+			return keypair
+		}
+	}
+	return nil
+}
+
+// rotate installs a keypair from a completed handshake.
+func (kp *Keypairs) rotate(keypair *Keypair) {
+	kp.Lock()
+	defer kp.Unlock()
+	if keypair.isInitiator {
+		if kp.next != nil {
+			kp.previous = kp.next
+			kp.next = nil
+		} else {
+			kp.previous = kp.current
+		}
+		kp.current = keypair
+	} else {
+		kp.next = keypair
+		kp.previous = nil
+	}
+}
+
+// received promotes next once the peer has sent with it.
+func (kp *Keypairs) received(keypair *Keypair) {
+	kp.Lock()
+	defer kp.Unlock()
+	if kp.next == keypair {
+		kp.previous = kp.current
+		kp.current = keypair
+		kp.next = nil
+	}
+}
+
+func (k *Keypair) needsRekey(now time.Time) bool {
+	return k.isInitiator && (atomic.LoadUint64(&k.sendNonce) >= RekeyAfterMessages || now.Sub(k.created) >= RekeyAfterTime)
+}
+
+func (k *Keypair) expired(now time.Time) bool {
+	return atomic.LoadUint64(&k.sendNonce) >= RejectAfterMessages || now.Sub(k.created) >= RejectAfterTime
+}
+
+func newPrivateKey(random io.Reader) (sk NoisePrivateKey, err error) {
+	err = readRandom(random, sk[:])
 	sk.clamp()
 	return
 }
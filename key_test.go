@@ -0,0 +1,101 @@
+package wireguard
+
+import (
+	"errors"
+	"testing"
+)
+
+// testKeypairs returns our keypair with localIndex and the peer's matching one.
+func testKeypairs(localIndex uint32, seed byte) (ours *Keypair, peers *Keypair) {
+	var sendKey, receiveKey [32]byte
+	for i := range sendKey {
+		sendKey[i] = seed + byte(i)
+		receiveKey[i] = seed + 0x80 + byte(i)
+	}
+
+	ours = newKeypair(sendKey, receiveKey)
+	ours.created = fixedNow()
+	ours.localIndex = localIndex
+	ours.isInitiator = true
+
+	peers = newKeypair(receiveKey, sendKey)
+	peers.remoteIndex = localIndex
+	return ours, peers
+}
+
+func TestKeypairRotation(t *testing.T) {
+	first, firstPeer := testKeypairs(1, 0x10)
+	second, _ := testKeypairs(2, 0x20)
+	third, _ := testKeypairs(3, 0x30)
+
+	keypairs := new(Keypairs)
+	keypairs.current = first
+
+	late, err := sealTransport([]byte("late reply"), firstPeer)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a reply sent before the peer saw the new keypair still decrypts
+	keypairs.rotate(second)
+	if keypairs.Current() != second {
+		t.Fatal("the new keypair is not current")
+	}
+	keypair, packet, err := openTransport(keypairs, append([]byte(nil), late...), fixedNow())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keypair != first || string(packet) != "late reply" {
+		t.Errorf("opened %q with keypair %d, want %q with 1", packet, keypair.localIndex, "late reply")
+	}
+
+	// two rotations later it is gone
+	keypairs.rotate(third)
+	_, _, err = openTransport(keypairs, append([]byte(nil), late...), fixedNow())
+	if !errors.Is(err, ErrDecryptFailed) {
+		t.Errorf("err = %v, want ErrDecryptFailed", err)
+	}
+}
+
+func TestKeypairRotationResponder(t *testing.T) {
+	first, _ := testKeypairs(1, 0x10)
+	second, _ := testKeypairs(2, 0x20)
+	first.isInitiator = false
+	second.isInitiator = false
+
+	keypairs := new(Keypairs)
+	keypairs.current = first
+
+	// the responder waits for the initiator to use the new keypair
+	keypairs.rotate(second)
+	if keypairs.Current() != first || keypairs.next != second {
+		t.Fatal("the new keypair was used before the initiator confirmed it")
+	}
+
+	keypairs.received(second)
+	if keypairs.Current() != second || keypairs.previous != first || keypairs.next != nil {
+		t.Error("the confirmed keypair did not become current")
+	}
+}
+
+func TestKeypairLifetime(t *testing.T) {
+	keypair, _ := testKeypairs(1, 0x10)
+
+	if keypair.needsRekey(fixedNow().Add(RekeyAfterTime - 1)) {
+		t.Error("rekey before REKEY_AFTER_TIME")
+	}
+	if !keypair.needsRekey(fixedNow().Add(RekeyAfterTime)) {
+		t.Error("no rekey at REKEY_AFTER_TIME")
+	}
+	if keypair.expired(fixedNow().Add(RejectAfterTime - 1)) {
+		t.Error("expired before REJECT_AFTER_TIME")
+	}
+	if !keypair.expired(fixedNow().Add(RejectAfterTime)) {
+		t.Error("not expired at REJECT_AFTER_TIME")
+	}
+
+	keypair.isInitiator = false
+	if keypair.needsRekey(fixedNow().Add(RekeyAfterTime)) {
+		t.Error("the responder rekeys")
+	}
+}
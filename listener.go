@@ -0,0 +1,364 @@
+package wireguard
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+type ListenerConfiguration struct {
+	PrivateKey    string
+	ListenAddress string           // local UDP address, e.g. ":51820"
+	IpAddress     string           // our address inside the tunnel, used as the source of sent datagrams
+	Peers         []string         // public keys of the peers allowed to connect
+	PresharedKey  string           // optional, shared with every peer
+	Rand          io.Reader        // as in Configuration
+	Now           func() time.Time // as in Configuration
+	MTU           int              // as in Configuration
+}
+
+// Listener is the responder side of the handshake. All sessions share one
+// socket: the listener answers initiations itself and hands transport
+// messages to the tunnel of the peer that owns the receiver index.
+type Listener struct {
+	config       ListenerConfiguration
+	random       io.Reader
+	now          func() time.Time
+	conn         *net.UDPConn
+	privateKey   NoisePrivateKey
+	presharedKey NoisePresharedKey
+	checker      CookieChecker
+
+	mutex   sync.Mutex
+	peers   map[NoisePublicKey]*listenerPeer
+	indices map[uint32]*listenerSession
+
+	accepted chan *Tunnel
+	done     chan struct{}
+	err      error
+}
+
+type listenerPeer struct {
+	publicKey     NoisePublicKey
+	lastTimestamp Timestamp
+	endpoint      *net.UDPAddr
+	latest        *Keypair // from the last handshake, for a tunnel started on an older one
+	tunnel        *Tunnel
+	conn          *peerConn
+}
+
+// listenerSession is a keypair we created as the responder. Until the peer
+// has used it there is no tunnel for a first session.
+type listenerSession struct {
+	peer    *listenerPeer
+	keypair *Keypair
+}
+
+func Listen(config ListenerConfiguration) (*Listener, error) {
+	listener := &Listener{
+		config:   config,
+		random:   entropy(config.Rand),
+		now:      clock(config.Now),
+		peers:    make(map[NoisePublicKey]*listenerPeer),
+		indices:  make(map[uint32]*listenerSession),
+		accepted: make(chan *Tunnel, receiveQueueSize),
+		done:     make(chan struct{}),
+	}
+
+	err := decodeBase64(listener.privateKey[:], config.PrivateKey)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidPrivateKey, err)
+	}
+	listener.privateKey.clamp()
+
+	listener.config.MTU, err = effectiveMTU(config.MTU)
+	if err != nil {
+		return nil, err
+	}
+
+	listener.checker.init(listener.privateKey.publicKey())
+
+	if config.PresharedKey != "" {
+		err = decodeBase64(listener.presharedKey[:], config.PresharedKey)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidPresharedKey, err)
+		}
+	}
+
+	for _, peer := range config.Peers {
+		var publicKey NoisePublicKey
+		err = decodeBase64(publicKey[:], peer)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidPublicKey, err)
+		}
+		listener.peers[publicKey] = &listenerPeer{publicKey: publicKey}
+	}
+
+	address, err := net.ResolveUDPAddr("udp4", config.ListenAddress)
+	if err != nil {
+		return nil, err
+	}
+
+	listener.conn, err = net.ListenUDP("udp4", address)
+	if err != nil {
+		return nil, err
+	}
+
+	go listener.readLoop()
+	return listener, nil
+}
+
+// Accept waits for a peer to complete a handshake and send its first message.
+// A peer that reconnects after its tunnel was closed is accepted again.
+func (l *Listener) Accept() (*Tunnel, error) {
+	select {
+	case tunnel := <-l.accepted:
+		return tunnel, nil
+	case <-l.done:
+		return nil, l.err
+	}
+}
+
+func (l *Listener) Addr() net.Addr {
+	return l.conn.LocalAddr()
+}
+
+func (l *Listener) Close() error {
+	return l.conn.Close()
+}
+
+func (l *Listener) readLoop() {
+	for {
+		buffer := make([]byte, receiveBufferSize(l.config.MTU))
+		length, address, err := l.conn.ReadFromUDP(buffer)
+		if errors.Is(err, net.ErrClosed) {
+			l.shutdown(err)
+			return
+		}
+		if err != nil || length < 4 {
+			continue
+		}
+
+		packet := buffer[:length]
+		switch binary.LittleEndian.Uint32(packet[0:4]) {
+		case MessageInitiationType:
+			if length == MessageInitiationSize {
+				l.consumeInitiation(packet, address)
+			}
+
+		case MessageTransportType:
+			if length >= MessageTransportSize {
+				l.routeTransport(packet)
+			}
+		}
+	}
+}
+
+func (l *Listener) consumeInitiation(packet []byte, address *net.UDPAddr) {
+	if !l.checker.checkMAC1(packet) {
+		return
+	}
+
+	received, err := consumeInitiation(packet, &l.privateKey)
+	if err != nil {
+		return
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	peer, ok := l.peers[received.handshake.remoteStatic]
+	if !ok {
+		return
+	}
+
+	// a replayed initiation carries an old timestamp
+	if bytes.Compare(received.timestamp[:], peer.lastTimestamp[:]) <= 0 {
+		return
+	}
+
+	received.handshake.presharedKey = l.presharedKey
+	keypair, response, err := received.createResponse(l.random, l.now)
+	if err != nil {
+		return
+	}
+
+	peer.lastTimestamp = received.timestamp
+	peer.endpoint = address
+
+	_, err = l.conn.WriteToUDP(response, address)
+	if err != nil {
+		return
+	}
+
+	l.sweep()
+	l.indices[keypair.localIndex] = &listenerSession{peer: peer, keypair: keypair}
+	peer.latest = keypair
+	if peer.tunnel != nil {
+		peer.tunnel.keypairs.rotate(keypair)
+	}
+}
+
+func (l *Listener) routeTransport(packet []byte) {
+	receiver := binary.LittleEndian.Uint32(packet[MessageTransportOffsetReceiver:MessageTransportOffsetCounter])
+
+	l.mutex.Lock()
+	session, ok := l.indices[receiver]
+	if !ok {
+		l.mutex.Unlock()
+		return
+	}
+
+	peer := session.peer
+	if peer.tunnel == nil {
+		// the receiver index is sent in clear, so only a message that
+		// decrypts shows the peer has the keypair
+		_, err := session.keypair.decrypt(nil, packet)
+		if err != nil {
+			l.mutex.Unlock()
+			return
+		}
+		l.startTunnel(peer, session.keypair)
+	}
+	conn := peer.conn
+	l.mutex.Unlock()
+
+	if conn != nil {
+		conn.deliver(packet)
+	}
+}
+
+// startTunnel creates the tunnel for a peer on the first authenticated message
+// of a new session, which confirms the keypair. A handshake that completed
+// since then waits in the tunnel for the peer to use its keypair.
+func (l *Listener) startTunnel(peer *listenerPeer, keypair *Keypair) {
+	peer.conn = &peerConn{
+		listener: l,
+		peer:     peer,
+		packets:  make(chan []byte, receiveQueueSize),
+		closed:   make(chan struct{}),
+	}
+
+	config := Configuration{
+		PublicKey:       base64.StdEncoding.EncodeToString(peer.publicKey[:]),
+		Endpoint:        peer.endpoint.String(),
+		ClientIpAddress: l.config.IpAddress,
+		Rand:            l.config.Rand,
+		Now:             l.config.Now,
+		MTU:             l.config.MTU,
+	}
+	peer.tunnel = newTunnel(config, nil, keypair, peer.conn)
+	peer.tunnel.responder = true
+	if peer.latest != nil && peer.latest != keypair {
+		peer.tunnel.keypairs.rotate(peer.latest)
+	}
+
+	select {
+	case l.accepted <- peer.tunnel:
+	default:
+		// nobody is accepting; the peer's next message tries again
+		peer.conn.shutdown()
+		peer.conn = nil
+		peer.tunnel = nil
+	}
+}
+
+// sweep forgets keypairs that can no longer be used. Called with the mutex held.
+func (l *Listener) sweep() {
+	for index, session := range l.indices {
+		if l.now().Sub(session.keypair.created) >= RejectAfterTime {
+			delete(l.indices, index)
+		}
+	}
+}
+
+func (l *Listener) shutdown(err error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	l.err = err
+	close(l.done)
+	for _, peer := range l.peers {
+		if peer.conn != nil {
+			peer.conn.shutdown()
+		}
+	}
+}
+
+// peerConn is the view of the shared socket given to a peer's tunnel.
+type peerConn struct {
+	listener  *Listener
+	peer      *listenerPeer
+	packets   chan []byte
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func (c *peerConn) deliver(packet []byte) {
+	select {
+	case c.packets <- packet:
+	default:
+	}
+}
+
+func (c *peerConn) Read(b []byte) (int, error) {
+	select {
+	case packet := <-c.packets:
+		return copy(b, packet), nil
+	case <-c.closed:
+		return 0, net.ErrClosed
+	}
+}
+
+func (c *peerConn) Write(b []byte) (int, error) {
+	select {
+	case <-c.closed:
+		return 0, net.ErrClosed
+	default:
+	}
+
+	c.listener.mutex.Lock()
+	endpoint := c.peer.endpoint
+	c.listener.mutex.Unlock()
+
+	return c.listener.conn.WriteToUDP(b, endpoint)
+}
+
+// Close detaches the tunnel, so that the peer's next session is accepted anew.
+func (c *peerConn) Close() error {
+	c.listener.mutex.Lock()
+	if c.peer.conn == c {
+		c.peer.conn = nil
+		c.peer.tunnel = nil
+	}
+	c.listener.mutex.Unlock()
+
+	c.shutdown()
+	return nil
+}
+
+func (c *peerConn) shutdown() {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+	})
+}
+
+func (c *peerConn) LocalAddr() net.Addr {
+	return c.listener.conn.LocalAddr()
+}
+
+func (c *peerConn) RemoteAddr() net.Addr {
+	c.listener.mutex.Lock()
+	defer c.listener.mutex.Unlock()
+	return c.peer.endpoint
+}
+
+func (c *peerConn) SetDeadline(t time.Time) error      { return nil }
+func (c *peerConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *peerConn) SetWriteDeadline(t time.Time) error { return nil }
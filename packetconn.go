@@ -0,0 +1,135 @@
+package wireguard
+
+import (
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// ListenPacket returns a net.PacketConn on port of our address inside the
+// tunnel, or on a free port when port is zero. It reads every datagram sent to
+// the port, whatever its source. Closing it leaves the tunnel open.
+func (t *Tunnel) ListenPacket(port int) (net.PacketConn, error) {
+	if port < 0 || port > 65535 {
+		return nil, ErrInvalidAddress
+	}
+
+	ip := net.ParseIP(t.config.ClientIpAddress)
+	if ip == nil {
+		return nil, ErrInvalidAddress
+	}
+
+	conn := &packetConn{
+		tunnel:        t,
+		packets:       make(chan *Datagram, receiveQueueSize),
+		readDeadline:  newDeadline(),
+		writeDeadline: newDeadline(),
+		closed:        make(chan struct{}),
+	}
+
+	port, err := t.bind(conn, port)
+	if err != nil {
+		return nil, err
+	}
+	conn.localAddress = &net.UDPAddr{IP: ip, Port: port}
+	return conn, nil
+}
+
+// packetConn is a port of ours inside the tunnel.
+type packetConn struct {
+	tunnel        *Tunnel
+	localAddress  *net.UDPAddr
+	packets       chan *Datagram
+	readDeadline  *deadline
+	writeDeadline *deadline
+	closed        chan struct{}
+	closeOnce     sync.Once
+}
+
+func (c *packetConn) receive(datagram *Datagram) bool {
+	select {
+	case c.packets <- datagram:
+	default:
+		// nobody is reading, drop it as the socket would
+	}
+	return true
+}
+
+// fail ignores socket errors, which an unconnected UDP socket does not see.
+func (c *packetConn) fail(err error) {}
+
+// ReadFrom reads the payload of a datagram; as with UDP, what does not fit in b
+// is discarded.
+func (c *packetConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	select {
+	case <-c.closed:
+		return 0, nil, net.ErrClosed
+	default:
+	}
+
+	select {
+	case datagram := <-c.packets:
+		address := &net.UDPAddr{IP: net.ParseIP(datagram.SourceIpAddress), Port: datagram.SourcePort}
+		return copy(b, datagram.Payload), address, nil
+	case <-c.readDeadline.wait():
+		return 0, nil, os.ErrDeadlineExceeded
+	case <-c.closed:
+		return 0, nil, net.ErrClosed
+	case <-c.tunnel.done:
+		return 0, nil, c.tunnel.err
+	}
+}
+
+// WriteTo sends b to a *net.UDPAddr inside the tunnel. Sending only blocks
+// while the tunnel waits for a new keypair, and the write deadline ends that.
+func (c *packetConn) WriteTo(b []byte, address net.Addr) (int, error) {
+	select {
+	case <-c.closed:
+		return 0, net.ErrClosed
+	case <-c.writeDeadline.wait():
+		return 0, os.ErrDeadlineExceeded
+	default:
+	}
+
+	destination, ok := address.(*net.UDPAddr)
+	if !ok {
+		return 0, ErrInvalidAddress
+	}
+
+	err := c.tunnel.send(b, c.localAddress.IP.String(), c.localAddress.Port, destination.IP.String(), destination.Port, PacketOptions{}, c.writeDeadline.wait())
+	if err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (c *packetConn) Close() error {
+	err := net.ErrClosed
+	c.closeOnce.Do(func() {
+		c.tunnel.unbind(c.localAddress.Port)
+		close(c.closed)
+		err = nil
+	})
+	return err
+}
+
+func (c *packetConn) LocalAddr() net.Addr {
+	return c.localAddress
+}
+
+func (c *packetConn) SetDeadline(t time.Time) error {
+	c.readDeadline.set(t)
+	c.writeDeadline.set(t)
+	return nil
+}
+
+func (c *packetConn) SetReadDeadline(t time.Time) error {
+	c.readDeadline.set(t)
+	return nil
+}
+
+func (c *packetConn) SetWriteDeadline(t time.Time) error {
+	c.writeDeadline.set(t)
+	return nil
+}
@@ -3,16 +3,38 @@ package wireguard
 import (
 	"crypto/rand"
 	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
 )
 
-func randUint16() (uint16) {
+var ErrEntropy = errors.New("failed to read randomness")
+
+// entropy returns the configured source of ephemeral keys, indices, source
+// ports and IP IDs, crypto/rand when none is set.
+func entropy(reader io.Reader) io.Reader {
+	if reader == nil {
+		return rand.Reader
+	}
+	return reader
+}
+
+func readRandom(reader io.Reader, b []byte) error {
+	_, err := io.ReadFull(reader, b)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrEntropy, err)
+	}
+	return nil
+}
+
+func randUint16(reader io.Reader) (uint16, error) {
 	var integer [2]byte
-	rand.Read(integer[:])
-	return binary.LittleEndian.Uint16(integer[:])
+	err := readRandom(reader, integer[:])
+	return binary.LittleEndian.Uint16(integer[:]), err
 }
 
-func randUint32() (uint32) {
+func randUint32(reader io.Reader) (uint32, error) {
 	var integer [4]byte
-	rand.Read(integer[:])
-	return binary.LittleEndian.Uint32(integer[:])
-}
\ No newline at end of file
+	err := readRandom(reader, integer[:])
+	return binary.LittleEndian.Uint32(integer[:]), err
+}
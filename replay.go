@@ -0,0 +1,64 @@
+package wireguard
+
+// The replay window of RFC 6479 as used by wireguard-go: a ring of bitmaps
+// over the counters just behind the newest one.
+const (
+	replayBlockBitLog = 6
+	replayBlockBits   = 1 << replayBlockBitLog
+	replayRingBlocks  = 1 << 7
+	replayWindowSize  = (replayRingBlocks - 1) * replayBlockBits
+	replayBlockMask   = replayRingBlocks - 1
+	replayBitMask     = replayBlockBits - 1
+)
+
+// replayFilter remembers the transport counters received on a keypair. Only
+// the reader of a tunnel uses it.
+type replayFilter struct {
+	last uint64
+	ring [replayRingBlocks]uint64
+}
+
+// seed starts the filter of a resumed keypair, on which the counters below next
+// were received before.
+func (f *replayFilter) seed(next uint64) {
+	if next == 0 {
+		return
+	}
+
+	f.last = next - 1
+	for i := range f.ring {
+		f.ring[i] = ^uint64(0)
+	}
+	// the counters after last in its block are still to come
+	f.ring[(f.last>>replayBlockBitLog)&replayBlockMask] = ^uint64(0) >> (replayBitMask - f.last&replayBitMask)
+}
+
+// validate reports whether counter is new and not too far behind the newest
+// one, and marks it as received. Call it only for authenticated messages, or a
+// forged counter moves the window.
+func (f *replayFilter) validate(counter uint64) bool {
+	if counter >= RejectAfterMessages {
+		return false
+	}
+
+	indexBlock := counter >> replayBlockBitLog
+	if counter > f.last {
+		current := f.last >> replayBlockBitLog
+		diff := indexBlock - current
+		if diff > replayRingBlocks {
+			diff = replayRingBlocks
+		}
+		for i := current + 1; i <= current+diff; i++ {
+			f.ring[i&replayBlockMask] = 0
+		}
+		f.last = counter
+	} else if f.last-counter > replayWindowSize {
+		return false
+	}
+
+	indexBlock &= replayBlockMask
+	indexBit := counter & replayBitMask
+	old := f.ring[indexBlock]
+	f.ring[indexBlock] = old | 1<<indexBit
+	return old != f.ring[indexBlock]
+}
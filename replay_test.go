@@ -0,0 +1,135 @@
+package wireguard
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestReplayFilter(t *testing.T) {
+	var filter replayFilter
+
+	steps := []struct {
+		counter uint64
+		want    bool
+	}{
+		{0, true},
+		{0, false},
+		{2, true},
+		{1, true},
+		{1, false},
+		{replayWindowSize + 2, true},
+		// 3 is still in the window, 1 is not
+		{3, true},
+		{3, false},
+		{1, false},
+		{3 * replayWindowSize, true},
+		{replayWindowSize + 2, false},
+		{3*replayWindowSize - 1, true},
+		{RejectAfterMessages, false},
+	}
+	for i, step := range steps {
+		if got := filter.validate(step.counter); got != step.want {
+			t.Errorf("step %d: validate(%d) = %v, want %v", i, step.counter, got, step.want)
+		}
+	}
+}
+
+func TestReplayFilterSeed(t *testing.T) {
+	for _, next := range []uint64{1, 64, 100, 3 * replayWindowSize} {
+		var filter replayFilter
+		filter.seed(next)
+
+		if filter.validate(next - 1) {
+			t.Errorf("seed(%d): last counter accepted again", next)
+		}
+		if next > replayWindowSize && filter.validate(next-replayWindowSize) {
+			t.Errorf("seed(%d): counter in the window accepted", next)
+		}
+		if !filter.validate(next) {
+			t.Errorf("seed(%d): next counter rejected", next)
+		}
+		if !filter.validate(next + 1) {
+			t.Errorf("seed(%d): counter after next rejected", next)
+		}
+	}
+}
+
+func TestOpenTransportReplay(t *testing.T) {
+	ours, peers := testKeypairs(1, 0x10)
+	keypairs := new(Keypairs)
+	keypairs.current = ours
+
+	first, err := sealTransport([]byte("first"), peers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := sealTransport([]byte("second"), peers)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// out of order within the window is fine
+	for _, message := range [][]byte{second, first} {
+		_, _, err = openTransport(keypairs, append([]byte(nil), message...), fixedNow())
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	_, _, err = openTransport(keypairs, append([]byte(nil), first...), fixedNow())
+	if !errors.Is(err, ErrReplayed) {
+		t.Errorf("replayed message: err = %v, want ErrReplayed", err)
+	}
+
+	// a forged message must not move the window
+	forged := append([]byte(nil), second...)
+	forged[8] = 0xff
+	forged[len(forged)-1] ^= 1
+	_, _, err = openTransport(keypairs, forged, fixedNow())
+	if !errors.Is(err, ErrDecryptFailed) {
+		t.Fatalf("forged message: err = %v, want ErrDecryptFailed", err)
+	}
+	third, err := sealTransport([]byte("third"), peers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = openTransport(keypairs, third, fixedNow())
+	if err != nil {
+		t.Errorf("message after a forged one: %v", err)
+	}
+}
+
+// A resumed keypair rejects what the saved one received.
+func TestResumedKeypairReplay(t *testing.T) {
+	ours, peers := testKeypairs(1, 0x10)
+	keypairs := &Keypairs{current: ours}
+
+	first, err := sealTransport([]byte("first"), peers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = openTransport(keypairs, append([]byte(nil), first...), fixedNow())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resumed := newKeypair(ours.sendKey, ours.receiveKey)
+	resumed.created = ours.created
+	resumed.localIndex = ours.localIndex
+	resumed.replay.seed(ours.receiveNonce)
+	keypairs = &Keypairs{current: resumed}
+
+	_, _, err = openTransport(keypairs, append([]byte(nil), first...), fixedNow())
+	if !errors.Is(err, ErrReplayed) {
+		t.Errorf("message received before resuming: err = %v, want ErrReplayed", err)
+	}
+
+	second, err := sealTransport([]byte("second"), peers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = openTransport(keypairs, second, fixedNow())
+	if err != nil {
+		t.Errorf("message after resuming: %v", err)
+	}
+}
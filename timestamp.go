@@ -7,6 +7,16 @@ import (
 
 type Timestamp [timestampSize]byte
 
+// clock returns the configured clock for timestamps, key lifetimes and rekey
+// attempts, time.Now when none is set. Timers, and the deadlines of sockets and
+// callers, always use the system clock.
+func clock(now func() time.Time) func() time.Time {
+	if now == nil {
+		return time.Now
+	}
+	return now
+}
+
 const timestampSize = 12
 const timestampBase = uint64(0x400000000000000a)
 const whitenerMask = uint32(0x1000000 - 1)
@@ -0,0 +1,480 @@
+package wireguard
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+var ErrSessionExpired = errors.New("session expired")
+
+const receiveQueueSize = 64
+
+// Tunnel is a session with the peer. A reader goroutine owns the socket: it
+// completes rekeying handshakes, hands datagrams to the requests of Exchange and
+// to packet conns by port, and queues the others for Receive.
+type Tunnel struct {
+	config    Configuration
+	client    *Client
+	random    io.Reader
+	now       func() time.Time
+	keypairs  Keypairs
+	conn      net.Conn
+	responder bool // accepted by a Listener, the peer is the one to rekey
+
+	handshakeMutex sync.Mutex
+	pending        *initiation   // rekeying handshake waiting for the response
+	rotated        chan struct{} // closed when a new keypair is installed
+
+	keepaliveMutex      sync.Mutex
+	persistentKeepalive *time.Timer
+	passiveKeepalive    *time.Timer
+	passivePending      bool
+	newHandshake        *time.Timer
+	newHandshakePending bool
+	closed              bool
+
+	received chan receiveResult
+	deadline *deadline
+	done     chan struct{} // closed when the reader stops
+	err      error         // why the reader stopped
+
+	bindingsMutex sync.Mutex
+	bindings      map[int]binding // our ports inside the tunnel in use
+}
+
+type receiveResult struct {
+	datagram *Datagram
+	err      error
+}
+
+// SessionState is everything needed to resume a tunnel in another process.
+type SessionState struct {
+	SendKey      [chacha20poly1305.KeySize]byte
+	ReceiveKey   [chacha20poly1305.KeySize]byte
+	LocalIndex   uint32
+	RemoteIndex  uint32
+	SendNonce    uint64 // next counter to send with
+	ReceiveNonce uint64 // above the highest counter received, older ones are replays
+	Created      time.Time
+	LocalAddress string // local UDP address, so the peer sees no roaming
+}
+
+type Datagram struct {
+	SourceIpAddress      string
+	SourcePort           int
+	DestinationIpAddress string
+	DestinationPort      int
+	Payload              []byte
+}
+
+// Dial performs a handshake with the peer of config. To dial repeatedly, create
+// a Client once instead.
+func Dial(config Configuration) (*Tunnel, error) {
+	client, err := NewClient(config)
+	if err != nil {
+		return nil, err
+	}
+	return client.Dial()
+}
+
+// Resume rebuilds a tunnel from a saved state without a handshake, see
+// Client.Resume.
+func Resume(config Configuration, state SessionState) (*Tunnel, error) {
+	client, err := NewClient(config)
+	if err != nil {
+		return nil, err
+	}
+	return client.Resume(state)
+}
+
+// newTunnel starts a tunnel on an established keypair. The client is nil for a
+// tunnel accepted by a Listener, which never initiates.
+func newTunnel(config Configuration, client *Client, keypair *Keypair, conn net.Conn) *Tunnel {
+	tunnel := &Tunnel{
+		config:   config,
+		client:   client,
+		random:   entropy(config.Rand),
+		now:      clock(config.Now),
+		conn:     conn,
+		rotated:  make(chan struct{}),
+		received: make(chan receiveResult, receiveQueueSize),
+		bindings: make(map[int]binding),
+		deadline: newDeadline(),
+		done:     make(chan struct{}),
+	}
+	tunnel.keypairs.current = keypair
+
+	if config.PersistentKeepalive > 0 {
+		tunnel.persistentKeepalive = time.AfterFunc(config.PersistentKeepalive, tunnel.keepalive)
+	}
+
+	go tunnel.readLoop()
+	return tunnel
+}
+
+func (t *Tunnel) Send(payload []byte, destinationIpAddress string, destinationPort int) error {
+	return t.SendWithOptions(payload, destinationIpAddress, destinationPort, PacketOptions{})
+}
+
+// SendWithOptions is Send with the given header fields.
+func (t *Tunnel) SendWithOptions(payload []byte, destinationIpAddress string, destinationPort int, options PacketOptions) error {
+	return t.send(payload, t.config.ClientIpAddress, options.SourcePort, destinationIpAddress, destinationPort, options, nil)
+}
+
+// Reply answers a received datagram from the address and port it was sent to.
+func (t *Tunnel) Reply(datagram *Datagram, payload []byte) error {
+	return t.send(payload, datagram.DestinationIpAddress, datagram.DestinationPort, datagram.SourceIpAddress, datagram.SourcePort, PacketOptions{}, nil)
+}
+
+// send gives up waiting for a new keypair when expired is closed; a nil channel
+// waits for as long as the handshake is retried.
+func (t *Tunnel) send(payload []byte, sourceIpAddress string, sourcePort int, destinationIpAddress string, destinationPort int, options PacketOptions, expired <-chan struct{}) error {
+	keypair, err := t.sendKeypair(expired)
+	if err != nil {
+		return err
+	}
+	err = udpSend(payload, sourceIpAddress, sourcePort, destinationIpAddress, destinationPort, options, t.config.MTU, t.random, keypair, t.conn)
+	if err != nil {
+		return err
+	}
+
+	t.dataSent()
+	return nil
+}
+
+func (t *Tunnel) Receive() (*Datagram, error) {
+	select {
+	case result := <-t.received:
+		return result.datagram, result.err
+	case <-t.deadline.wait():
+		return nil, os.ErrDeadlineExceeded
+	case <-t.done:
+		return nil, t.err
+	}
+}
+
+func (t *Tunnel) UdpOneShot(payload []byte, destinationIpAddress string, destinationPort int) ([]byte, error) {
+	return t.UdpOneShotWithOptions(payload, destinationIpAddress, destinationPort, PacketOptions{})
+}
+
+// UdpOneShotWithOptions is UdpOneShot with the given header fields.
+func (t *Tunnel) UdpOneShotWithOptions(payload []byte, destinationIpAddress string, destinationPort int, options PacketOptions) ([]byte, error) {
+	err := t.SendWithOptions(payload, destinationIpAddress, destinationPort, options)
+	if err != nil {
+		return nil, err
+	}
+
+	destinationIp := net.ParseIP(destinationIpAddress)
+	for {
+		datagram, err := t.Receive()
+		if err != nil {
+			return nil, err
+		}
+
+		// skip late replies to earlier requests on the same session
+		if datagram.SourcePort == destinationPort && net.ParseIP(datagram.SourceIpAddress).Equal(destinationIp) {
+			return datagram.Payload, nil
+		}
+	}
+}
+
+func (t *Tunnel) Created() time.Time {
+	return t.keypairs.Current().created
+}
+
+func (t *Tunnel) State() SessionState {
+	keypair := t.keypairs.Current()
+	return SessionState{
+		SendKey:      keypair.sendKey,
+		ReceiveKey:   keypair.receiveKey,
+		LocalIndex:   keypair.localIndex,
+		RemoteIndex:  keypair.remoteIndex,
+		SendNonce:    atomic.LoadUint64(&keypair.sendNonce),
+		ReceiveNonce: atomic.LoadUint64(&keypair.receiveNonce),
+		Created:      keypair.created,
+		LocalAddress: t.conn.LocalAddr().String(),
+	}
+}
+
+func (t *Tunnel) SetReadDeadline(deadline time.Time) error {
+	t.deadline.set(deadline)
+	return nil
+}
+
+func (t *Tunnel) Close() error {
+	t.keepaliveMutex.Lock()
+	t.closed = true
+	if t.persistentKeepalive != nil {
+		t.persistentKeepalive.Stop()
+	}
+	if t.passiveKeepalive != nil {
+		t.passiveKeepalive.Stop()
+	}
+	if t.newHandshake != nil {
+		t.newHandshake.Stop()
+	}
+	t.keepaliveMutex.Unlock()
+
+	return t.conn.Close()
+}
+
+// sendKeypair returns the keypair to send with. It starts a handshake once the
+// current keypair is due for rekeying, and waits for the new one when the
+// current keypair must no longer be used, until expired is closed.
+func (t *Tunnel) sendKeypair(expired <-chan struct{}) (*Keypair, error) {
+	giveUp := t.now().Add(RekeyAttemptTime)
+	for {
+		t.handshakeMutex.Lock()
+		rotated := t.rotated
+		t.handshakeMutex.Unlock()
+
+		keypair := t.keypairs.Current()
+		if !keypair.expired(t.now()) {
+			if keypair.needsRekey(t.now()) {
+				// keep sending on the current keypair meanwhile
+				t.initiate()
+			}
+			return keypair, nil
+		}
+
+		if t.responder || t.now().After(giveUp) {
+			return nil, ErrSessionExpired
+		}
+
+		select {
+		case <-expired:
+			return nil, os.ErrDeadlineExceeded
+		default:
+		}
+
+		err := t.initiate()
+		if err != nil {
+			return nil, err
+		}
+
+		timer := time.NewTimer(RekeyTimeout)
+		select {
+		case <-rotated:
+		case <-timer.C:
+		case <-expired:
+			timer.Stop()
+			return nil, os.ErrDeadlineExceeded
+		case <-t.done:
+			timer.Stop()
+			return nil, t.err
+		}
+		timer.Stop()
+	}
+}
+
+// initiate sends a handshake initiation unless one is already waiting for its
+// response, in which case it is retransmitted after REKEY_TIMEOUT.
+func (t *Tunnel) initiate() error {
+	t.handshakeMutex.Lock()
+	defer t.handshakeMutex.Unlock()
+
+	if t.pending != nil && t.now().Sub(t.pending.sent) < RekeyTimeout {
+		return nil
+	}
+
+	initiation, err := t.client.createInitiation()
+	if err != nil {
+		return err
+	}
+
+	_, err = t.conn.Write(initiation.packet)
+	if err != nil {
+		return err
+	}
+	initiation.sent = t.now()
+	t.pending = initiation
+	return nil
+}
+
+func (t *Tunnel) consumeResponse(packet []byte) {
+	t.handshakeMutex.Lock()
+	defer t.handshakeMutex.Unlock()
+
+	if t.pending == nil {
+		return
+	}
+
+	keypair, err := t.pending.consumeResponse(packet)
+	if err != nil {
+		return
+	}
+	t.pending = nil
+
+	t.keypairs.rotate(keypair)
+	close(t.rotated)
+	t.rotated = make(chan struct{})
+
+	// the responder only starts using the new keypair once it has seen it used
+	if sendKeepalive(keypair, t.conn) == nil {
+		t.packetTraversed()
+	}
+}
+
+func (t *Tunnel) consumeCookieReply(packet []byte) {
+	t.handshakeMutex.Lock()
+	defer t.handshakeMutex.Unlock()
+
+	if t.pending != nil && t.pending.consumeCookieReply(packet) {
+		t.conn.Write(t.pending.packet)
+	}
+}
+
+func (t *Tunnel) readLoop() {
+	for {
+		buffer := make([]byte, receiveBufferSize(t.config.MTU))
+		length, err := t.conn.Read(buffer)
+		if errors.Is(err, net.ErrClosed) {
+			t.err = err
+			close(t.done)
+			return
+		}
+		if err != nil {
+			// e.g. ICMP port unreachable, the socket is still usable
+			t.fail(err)
+			continue
+		}
+
+		if length < 4 {
+			continue
+		}
+
+		switch binary.LittleEndian.Uint32(buffer[0:4]) {
+		case MessageResponseType:
+			t.consumeResponse(buffer[:length])
+
+		case MessageCookieReplyType:
+			t.consumeCookieReply(buffer[:length])
+
+		case MessageTransportType:
+			keypair, packet, err := openTransport(&t.keypairs, buffer[:length], t.now())
+			if errors.Is(err, ErrInvalidPacket) || errors.Is(err, ErrSessionExpired) || errors.Is(err, ErrReplayed) {
+				continue
+			}
+			if err != nil {
+				t.deliver(nil, err)
+				continue
+			}
+
+			t.keypairs.received(keypair)
+			t.packetTraversed()
+			t.authenticatedReceived()
+
+			// as the initiator, renew a session the peer keeps using before it
+			// runs out, even when we are only receiving
+			if keypair.isInitiator && keypair == t.keypairs.Current() &&
+				t.now().Sub(keypair.created) >= RejectAfterTime-KeepaliveTimeout-RekeyTimeout {
+				t.initiate()
+			}
+
+			// keepalive
+			if packet == nil {
+				continue
+			}
+
+			t.dataReceived()
+			datagram, err := parseHeader(packet)
+			if err != nil {
+				t.deliver(nil, err)
+				continue
+			}
+			t.dispatch(datagram)
+		}
+	}
+}
+
+// deliver queues a result for Receive, dropping it when nobody is reading, as
+// the socket would.
+func (t *Tunnel) deliver(datagram *Datagram, err error) {
+	select {
+	case t.received <- receiveResult{datagram, err}:
+	default:
+	}
+}
+
+func (t *Tunnel) keepalive() {
+	keypair, err := t.sendKeypair(nil)
+	if err == nil {
+		sendKeepalive(keypair, t.conn)
+	}
+
+	// re-arms the persistent keepalive, also after a failure
+	t.packetTraversed()
+}
+
+// packetTraversed postpones the persistent keepalive, which is only needed
+// while nothing else passes through the tunnel.
+func (t *Tunnel) packetTraversed() {
+	t.keepaliveMutex.Lock()
+	defer t.keepaliveMutex.Unlock()
+	if t.persistentKeepalive != nil && !t.closed {
+		t.persistentKeepalive.Reset(t.config.PersistentKeepalive)
+	}
+}
+
+// As in wireguard-go, data received without sending anything back within
+// KEEPALIVE_TIMEOUT is acknowledged with a keepalive, so the peer knows the
+// session is alive.
+func (t *Tunnel) dataReceived() {
+	t.keepaliveMutex.Lock()
+	defer t.keepaliveMutex.Unlock()
+	if t.passivePending || t.closed {
+		return
+	}
+
+	t.passivePending = true
+	t.passiveKeepalive = time.AfterFunc(KeepaliveTimeout, func() {
+		t.keepaliveMutex.Lock()
+		t.passivePending = false
+		t.keepaliveMutex.Unlock()
+		t.keepalive()
+	})
+}
+
+func (t *Tunnel) dataSent() {
+	t.keepaliveMutex.Lock()
+	defer t.keepaliveMutex.Unlock()
+	if t.passivePending {
+		t.passiveKeepalive.Stop()
+		t.passivePending = false
+	}
+	if t.persistentKeepalive != nil && !t.closed {
+		t.persistentKeepalive.Reset(t.config.PersistentKeepalive)
+	}
+
+	// As in wireguard-go, data that gets nothing back, not even a passive
+	// keepalive, within KEEPALIVE_TIMEOUT + REKEY_TIMEOUT means the peer may
+	// have lost the session, e.g. by restarting, so we handshake again.
+	if t.responder || t.newHandshakePending || t.closed {
+		return
+	}
+	t.newHandshakePending = true
+	t.newHandshake = time.AfterFunc(KeepaliveTimeout+RekeyTimeout, func() {
+		t.keepaliveMutex.Lock()
+		t.newHandshakePending = false
+		t.keepaliveMutex.Unlock()
+		t.initiate()
+	})
+}
+
+// authenticatedReceived shows the peer still has the session.
+func (t *Tunnel) authenticatedReceived() {
+	t.keepaliveMutex.Lock()
+	defer t.keepaliveMutex.Unlock()
+	if t.newHandshakePending {
+		t.newHandshake.Stop()
+		t.newHandshakePending = false
+	}
+}
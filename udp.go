@@ -2,7 +2,12 @@ package wireguard
 
 import (
 	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
 	"net"
+	"sync/atomic"
+	"time"
 
 	"golang.org/x/crypto/chacha20poly1305"
 )
@@ -10,130 +15,339 @@ import (
 const PaddingSize = 16
 const UdpRecieveSize = 1500
 
+const (
+	IpHeaderSize   = 20
+	Ipv6HeaderSize = 40
+	UdpHeaderSize  = 8
+)
+
+const (
+	DefaultMTU     = 1420                                      // same as wireguard-go
+	MinMTU         = 576                                       // smallest datagram every IPv4 host accepts
+	MaxMTU         = 65507 - MessageTransportSize              // largest whose transport message fits one outer datagram
+	MaxPayloadSize = DefaultMTU - IpHeaderSize - UdpHeaderSize // largest payload fitting in one inner packet at DefaultMTU
+)
+
 const (
 	MessageTransportOffsetReceiver = 4
 	MessageTransportOffsetCounter  = 8
 	MessageTransportOffsetContent  = 16
 )
 
-func udpOneShot(payload []byte, destinationIpAddress string, destinationPort int, clientIpAddress string, keypair *Keypair, conn net.Conn) ([]byte, error) {
-	err := udpSend(payload, destinationIpAddress, destinationPort, clientIpAddress, keypair, conn)
+var (
+	ErrInvalidPacket  = errors.New("invalid packet")
+	ErrInvalidAddress = errors.New("invalid address")
+	ErrDecryptFailed  = errors.New("failed to decrypt transport message")
+	ErrReplayed       = errors.New("replayed transport message")
+
+	ErrInvalidPacketOptions = errors.New("invalid packet options")
+	ErrInvalidMTU           = errors.New("invalid MTU")
+	ErrPayloadTooLarge      = errors.New("payload too large")
+)
+
+const DefaultTTL = 64
+
+// PacketOptions sets fields of the inner IP and UDP headers of a request. The
+// zero value is what Send uses.
+type PacketOptions struct {
+	SourcePort         int  // zero picks a free port
+	TTL                int  // hop limit for IPv6, zero means DefaultTTL
+	DSCP               int  // 0 to 63
+	AllowFragmentation bool // clears the don't fragment bit; IPv4 only
+}
+
+func (o PacketOptions) validate() error {
+	if o.SourcePort < 0 || o.SourcePort > 65535 {
+		return fmt.Errorf("%w: source port %d", ErrInvalidPacketOptions, o.SourcePort)
+	}
+	if o.TTL < 0 || o.TTL > 255 {
+		return fmt.Errorf("%w: TTL %d", ErrInvalidPacketOptions, o.TTL)
+	}
+	if o.DSCP < 0 || o.DSCP > 63 {
+		return fmt.Errorf("%w: DSCP %d", ErrInvalidPacketOptions, o.DSCP)
+	}
+	return nil
+}
+
+func (o PacketOptions) ttl() byte {
+	if o.TTL == 0 {
+		return DefaultTTL
+	}
+	return byte(o.TTL)
+}
+
+func createHeader(payload []byte, sourceIpAddress string, sourcePort int, destinationIpAddress string, destinationPort int, options PacketOptions, random io.Reader) ([]byte, error) {
+	err := options.validate()
 	if err != nil {
 		return nil, err
 	}
 
-    receivedBuffer, err := udpReceive(keypair, conn)
-    if err != nil {
-        return nil, err
-    }
-	
-	return receivedBuffer, nil
-}
+	sourceIp := net.ParseIP(sourceIpAddress)
+	destinationIp := net.ParseIP(destinationIpAddress)
+	if sourceIp == nil || destinationIp == nil || (sourceIp.To4() == nil) != (destinationIp.To4() == nil) {
+		return nil, ErrInvalidAddress
+	}
 
-func createHeader(payload []byte, sourceIpAddress string, destinationIpAddress string, destinationPort int) []byte {
-	udpHeader := make([]byte, 8)
-	sourcePort := randUint16()
+	udpHeader := make([]byte, UdpHeaderSize)
+	if sourcePort == 0 {
+		port, err := randUint16(random)
+		if err != nil {
+			return nil, err
+		}
+		sourcePort = int(port)
+	}
 
-	binary.BigEndian.PutUint16(udpHeader[0:2], sourcePort)
+	binary.BigEndian.PutUint16(udpHeader[0:2], uint16(sourcePort))
 	binary.BigEndian.PutUint16(udpHeader[2:4], uint16(destinationPort))
 	binary.BigEndian.PutUint16(udpHeader[4:6], uint16(len(udpHeader) + len(payload)))
 
-	ipHeader := make([]byte, 20)
-	ipHeader[0] = 0x45
-	ipHeader[1] = 0x00
-	binary.BigEndian.PutUint16(ipHeader[2:4], uint16(len(ipHeader) + len(udpHeader) + len(payload)))
-	binary.BigEndian.PutUint16(ipHeader[4:6], randUint16())
-	binary.BigEndian.PutUint16(ipHeader[6:8], 0x02 << 13)
-	ipHeader[8] = 0x40
-	ipHeader[9] = 0x11
-
-	sourceIp := net.ParseIP(sourceIpAddress).To4()
-	copy(ipHeader[12:16], sourceIp)
-	destinationIp := net.ParseIP(destinationIpAddress).To4()
-	copy(ipHeader[16:20], destinationIp)
-	var ipChecksum uint32 = 0
-	for i := 0; i < len(ipHeader) ; i += 2 {
-		ipChecksum += (uint32(ipHeader[i]) << 8) + uint32(ipHeader[i + 1])
-	}
-	ipChecksum = (ipChecksum & 0xffff) + (ipChecksum >> 16)
-	binary.BigEndian.PutUint16(ipHeader[10:12], ^(uint16(ipChecksum)))
-
+	var ipHeader []byte
 	var udpChecksum uint32 = 0
-	for i := 12; i < 20; i += 2 {
-		udpChecksum += (uint32(ipHeader[i]) << 8) + uint32(ipHeader[i + 1])
+	if sourceIp.To4() != nil {
+		id, err := randUint16(random)
+		if err != nil {
+			return nil, err
+		}
+
+		ipHeader = make([]byte, IpHeaderSize)
+		ipHeader[0] = 0x45
+		ipHeader[1] = byte(options.DSCP << 2)
+		binary.BigEndian.PutUint16(ipHeader[2:4], uint16(len(ipHeader) + len(udpHeader) + len(payload)))
+		binary.BigEndian.PutUint16(ipHeader[4:6], id)
+		if !options.AllowFragmentation {
+			binary.BigEndian.PutUint16(ipHeader[6:8], 0x02 << 13)
+		}
+		ipHeader[8] = options.ttl()
+		ipHeader[9] = 0x11
+
+		copy(ipHeader[12:16], sourceIp.To4())
+		copy(ipHeader[16:20], destinationIp.To4())
+		binary.BigEndian.PutUint16(ipHeader[10:12], ^foldChecksum(checksum(0, ipHeader)))
+
+		udpChecksum = checksum(udpChecksum, ipHeader[12:20])
+	} else {
+		ipHeader = make([]byte, Ipv6HeaderSize)
+		// the traffic class straddles the first two bytes
+		ipHeader[0] = 0x60 | byte(options.DSCP >> 2)
+		ipHeader[1] = byte(options.DSCP << 6)
+		binary.BigEndian.PutUint16(ipHeader[4:6], uint16(len(udpHeader) + len(payload)))
+		ipHeader[6] = 0x11
+		ipHeader[7] = options.ttl()
+
+		copy(ipHeader[8:24], sourceIp.To16())
+		copy(ipHeader[24:40], destinationIp.To16())
+
+		udpChecksum = checksum(udpChecksum, ipHeader[8:40])
 	}
-	udpChecksum += uint32(ipHeader[9])
+
+	udpChecksum += 0x11
 	udpChecksum += uint32(len(udpHeader) + len(payload))
-	for i := 0; i < len(udpHeader) ; i += 2 {
-		udpChecksum += (uint32(udpHeader[i]) << 8) + uint32(udpHeader[i + 1])
+	udpChecksum = checksum(udpChecksum, udpHeader)
+	udpChecksum = checksum(udpChecksum, payload)
+	result := ^foldChecksum(udpChecksum)
+	if result == 0 {
+		// zero means no checksum, which IPv6 does not allow
+		result = 0xffff
 	}
-	for i := 0; i < len(payload) ; i += 2 {
-		udpChecksum += uint32(payload[i]) << 8
-		if i + 1 < len(payload) {
-			udpChecksum += uint32(payload[i + 1])
+	binary.BigEndian.PutUint16(udpHeader[6:8], result)
+
+	ret := append(ipHeader, udpHeader...)
+	return ret, nil
+}
+
+// checksum adds data to an internet checksum as 16 bit big endian words.
+func checksum(sum uint32, data []byte) uint32 {
+	for i := 0; i < len(data); i += 2 {
+		sum += uint32(data[i]) << 8
+		if i + 1 < len(data) {
+			sum += uint32(data[i + 1])
 		}
 	}
-	udpChecksum = (udpChecksum & 0xffff) + (udpChecksum >> 16)
-	binary.BigEndian.PutUint16(udpHeader[6:8], ^(uint16(udpChecksum)))
+	return sum
+}
 
-	ret := append(ipHeader, udpHeader...)
-	return ret
+func foldChecksum(sum uint32) uint16 {
+	for sum > 0xffff {
+		sum = (sum & 0xffff) + (sum >> 16)
+	}
+	return uint16(sum)
 }
 
-func udpSend(payload []byte, destinationIpAddress string, destinationPort int, clientIpAddress string, keypair *Keypair, conn net.Conn) error {
-	payloadHeader := createHeader(payload, clientIpAddress, destinationIpAddress, destinationPort)
+// udpSend sends payload as one inner packet of at most mtu bytes. Larger ones
+// are refused rather than fragmented, as fragments tend to get lost on mobile
+// networks.
+func udpSend(payload []byte, sourceIpAddress string, sourcePort int, destinationIpAddress string, destinationPort int, options PacketOptions, mtu int, random io.Reader, keypair *Keypair, conn net.Conn) error {
+	payloadHeader, err := createHeader(payload, sourceIpAddress, sourcePort, destinationIpAddress, destinationPort, options, random)
+	if err != nil {
+		return err
+	}
 
 	packet := make([]byte, len(payloadHeader) + len(payload))
-	var header [MessageTransportHeaderSize]byte
 	copy(packet[0:len(payloadHeader)], payloadHeader[:])
 	copy(packet[len(payloadHeader):len(payloadHeader) + len(payload)], payload[:])
 
+	if len(packet) > mtu {
+		return fmt.Errorf("%w: %d bytes with headers, MTU %d", ErrPayloadTooLarge, len(packet), mtu)
+	}
+
+	packet = append(packet, make([]byte, paddingSize(len(packet), mtu))...)
+
+	return sendTransport(packet, keypair, conn)
+}
+
+// paddingSize pads a packet to a multiple of PaddingSize but not beyond the MTU,
+// as wireguard-go does.
+func paddingSize(packetSize int, mtu int) int {
+	lastUnit := packetSize
+	if lastUnit > mtu {
+		lastUnit %= mtu
+	}
+
+	paddedSize := (lastUnit + PaddingSize - 1) / PaddingSize * PaddingSize
+	if paddedSize > mtu {
+		paddedSize = mtu
+	}
+	return paddedSize - lastUnit
+}
+
+// receiveBufferSize fits a transport message carrying an inner packet of mtu
+// bytes.
+func receiveBufferSize(mtu int) int {
+	if mtu + MessageTransportSize > UdpRecieveSize {
+		return mtu + MessageTransportSize
+	}
+	return UdpRecieveSize
+}
+
+// sendKeepalive sends a transport message with no content.
+func sendKeepalive(keypair *Keypair, conn net.Conn) error {
+	return sendTransport(nil, keypair, conn)
+}
+
+func sendTransport(packet []byte, keypair *Keypair, conn net.Conn) error {
+	packet, err := sealTransport(packet, keypair)
+	if err != nil {
+		return err
+	}
+
+	_, err = conn.Write(packet)
+	if err != nil {
+        return err
+    }
+
+	return nil
+}
+
+// sealTransport encrypts packet into a transport message with the next nonce.
+func sealTransport(packet []byte, keypair *Keypair) ([]byte, error) {
+	var header [MessageTransportHeaderSize]byte
 	var senderNonce [chacha20poly1305.NonceSize]byte
+	nonce := atomic.AddUint64(&keypair.sendNonce, 1) - 1
+	if nonce >= RejectAfterMessages {
+		return nil, ErrSessionExpired
+	}
 	binary.LittleEndian.PutUint32(header[0:4], MessageTransportType)
 	binary.LittleEndian.PutUint32(header[4:8], keypair.remoteIndex)
-	binary.LittleEndian.PutUint64(header[8:16], 0)
+	binary.LittleEndian.PutUint64(header[8:16], nonce)
 
-	paddingData := make([]byte, PaddingSize)
-	paddingSize := (PaddingSize - (len(packet) % PaddingSize)) % PaddingSize
-	packet = append(packet, paddingData[:paddingSize]...)
-
-	binary.LittleEndian.PutUint64(senderNonce[4:], 0)
+	binary.LittleEndian.PutUint64(senderNonce[4:], nonce)
 	packet = keypair.send.Seal(
 		header[:],
 		senderNonce[:],
 		packet,
 		nil,
 	)
+	return packet, nil
+}
+
+// openTransport decrypts a transport message in place. It returns the
+// keypair it was sent with, and a nil packet for a keepalive. A message whose
+// counter was seen before is refused with ErrReplayed.
+func openTransport(keypairs *Keypairs, packet []byte, now time.Time) (*Keypair, []byte, error) {
+	if len(packet) < MessageTransportSize {
+		return nil, nil, ErrInvalidPacket
+	}
+
+	keypair := keypairs.lookup(binary.LittleEndian.Uint32(packet[MessageTransportOffsetReceiver:MessageTransportOffsetCounter]))
+	if keypair == nil {
+		return nil, nil, ErrDecryptFailed
+	}
+
+	counter := binary.LittleEndian.Uint64(packet[MessageTransportOffsetCounter:MessageTransportOffsetContent])
+	if counter >= RejectAfterMessages || now.Sub(keypair.created) >= RejectAfterTime {
+		return nil, nil, ErrSessionExpired
+	}
 
-	_, err := conn.Write(packet)
+	receivedPacket, err := keypair.decrypt(packet[MessageTransportOffsetContent:MessageTransportOffsetContent], packet)
 	if err != nil {
-        return err
-    }
+		return nil, nil, ErrDecryptFailed
+	}
 
-	return nil
-}
+	if !keypair.replay.validate(counter) {
+		return nil, nil, ErrReplayed
+	}
+	if counter >= atomic.LoadUint64(&keypair.receiveNonce) {
+		atomic.StoreUint64(&keypair.receiveNonce, counter+1)
+	}
 
-func udpReceive(keypair *Keypair, conn net.Conn) ([]byte, error) {
-	receiveBuffer := make([]byte, UdpRecieveSize)
-    receivedLength, err := conn.Read(receiveBuffer)
-    if err != nil {
-        return nil, err
-    }
+	if len(receivedPacket) == 0 {
+		return keypair, nil, nil
+	}
+	return keypair, receivedPacket, nil
+}
 
+// decrypt appends the content of a transport message to dst. It leaves the
+// replay filter alone.
+func (k *Keypair) decrypt(dst, packet []byte) ([]byte, error) {
 	var receiverNonce [chacha20poly1305.NonceSize]byte
-	counter := receiveBuffer[MessageTransportOffsetCounter:MessageTransportOffsetContent]
-	content := receiveBuffer[MessageTransportOffsetContent:receivedLength]
-	copy(receiverNonce[0x4:0xc], counter)
-	receivedPacket, err := keypair.receive.Open(
-		content[:0],
-		receiverNonce[:],
-		content,
-		nil,
-	)
-	if err != nil {
-		return nil, err
+	copy(receiverNonce[0x4:0xc], packet[MessageTransportOffsetCounter:MessageTransportOffsetContent])
+	return k.receive.Open(dst, receiverNonce[:], packet[MessageTransportOffsetContent:], nil)
+}
+
+func parseHeader(packet []byte) (*Datagram, error) {
+	if len(packet) > 0 && packet[0] >> 4 == 6 {
+		return parseIpv6Header(packet)
+	}
+
+	if len(packet) < IpHeaderSize + UdpHeaderSize || packet[0] >> 4 != 4 || packet[9] != 0x11 {
+		return nil, ErrInvalidPacket
 	}
 
-	receivedBuffer := receivedPacket[20 + 8:]
-	return receivedBuffer, nil
-}
\ No newline at end of file
+	ipHeaderLength := int(packet[0] & 0x0f) * 4
+	ipTotalLength := int(binary.BigEndian.Uint16(packet[2:4]))
+	if ipHeaderLength < IpHeaderSize || ipTotalLength < ipHeaderLength + UdpHeaderSize || ipTotalLength > len(packet) {
+		return nil, ErrInvalidPacket
+	}
+
+	return parseUdpHeader(packet[ipHeaderLength:ipTotalLength], net.IP(packet[12:16]), net.IP(packet[16:20]))
+}
+
+// Extension headers are not supported, the next header has to be UDP.
+func parseIpv6Header(packet []byte) (*Datagram, error) {
+	if len(packet) < Ipv6HeaderSize + UdpHeaderSize || packet[6] != 0x11 {
+		return nil, ErrInvalidPacket
+	}
+
+	payloadLength := int(binary.BigEndian.Uint16(packet[4:6]))
+	if payloadLength < UdpHeaderSize || Ipv6HeaderSize + payloadLength > len(packet) {
+		return nil, ErrInvalidPacket
+	}
+
+	return parseUdpHeader(packet[Ipv6HeaderSize:Ipv6HeaderSize + payloadLength], net.IP(packet[8:24]), net.IP(packet[24:40]))
+}
+
+func parseUdpHeader(udpHeader []byte, sourceIp net.IP, destinationIp net.IP) (*Datagram, error) {
+	udpLength := int(binary.BigEndian.Uint16(udpHeader[4:6]))
+	if udpLength < UdpHeaderSize || udpLength > len(udpHeader) {
+		return nil, ErrInvalidPacket
+	}
+
+	datagram := &Datagram{
+		SourceIpAddress:      sourceIp.String(),
+		SourcePort:           int(binary.BigEndian.Uint16(udpHeader[0:2])),
+		DestinationIpAddress: destinationIp.String(),
+		DestinationPort:      int(binary.BigEndian.Uint16(udpHeader[2:4])),
+		Payload:              udpHeader[UdpHeaderSize:udpLength],
+	}
+	return datagram, nil
+}
@@ -0,0 +1,82 @@
+package wireguard
+
+import (
+	"encoding/binary"
+	"errors"
+	"testing"
+)
+
+func TestPacketOptions(t *testing.T) {
+	options := PacketOptions{TTL: 3, DSCP: 46}
+
+	header, err := createHeader([]byte("hello"), "10.0.0.2", 1234, "10.0.0.1", 7, options, &counterReader{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header[1] != 46<<2 {
+		t.Errorf("TOS = %#x, want %#x", header[1], 46<<2)
+	}
+	if flags := binary.BigEndian.Uint16(header[6:8]); flags != 0x4000 {
+		t.Errorf("flags = %#x, want DF", flags)
+	}
+	if header[8] != 3 {
+		t.Errorf("TTL = %d, want 3", header[8])
+	}
+	if foldChecksum(checksum(0, header[:IpHeaderSize])) != 0xffff {
+		t.Error("bad IPv4 header checksum")
+	}
+
+	options.AllowFragmentation = true
+	header, err = createHeader([]byte("hello"), "10.0.0.2", 1234, "10.0.0.1", 7, options, &counterReader{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if flags := binary.BigEndian.Uint16(header[6:8]); flags != 0 {
+		t.Errorf("flags = %#x, want none", flags)
+	}
+
+	header, err = createHeader([]byte("hello"), "fd00::2", 1234, "fd00::1", 7, options, &counterReader{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if trafficClass := binary.BigEndian.Uint16(header[0:2]) >> 4 & 0xff; trafficClass != 46<<2 {
+		t.Errorf("traffic class = %#x, want %#x", trafficClass, 46<<2)
+	}
+	if header[7] != 3 {
+		t.Errorf("hop limit = %d, want 3", header[7])
+	}
+
+	header, err = createHeader([]byte("hello"), "10.0.0.2", 1234, "10.0.0.1", 7, PacketOptions{}, &counterReader{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header[1] != 0 || header[8] != DefaultTTL {
+		t.Errorf("TOS %#x and TTL %d by default, want 0 and %d", header[1], header[8], DefaultTTL)
+	}
+
+	for _, options := range []PacketOptions{{SourcePort: 65536}, {TTL: 256}, {TTL: -1}, {DSCP: 64}} {
+		_, err := createHeader([]byte("hello"), "10.0.0.2", 1234, "10.0.0.1", 7, options, &counterReader{})
+		if !errors.Is(err, ErrInvalidPacketOptions) {
+			t.Errorf("%+v: err = %v, want ErrInvalidPacketOptions", options, err)
+		}
+	}
+}
+
+func TestPaddingSize(t *testing.T) {
+	for _, test := range []struct {
+		packetSize, mtu, want int
+	}{
+		{0, DefaultMTU, 0},
+		{1, DefaultMTU, 15},
+		{16, DefaultMTU, 0},
+		{33, DefaultMTU, 15},
+		// not beyond the MTU, which is no multiple of 16
+		{1415, DefaultMTU, 5},
+		{1420, DefaultMTU, 0},
+		{1280, 1280, 0},
+	} {
+		if got := paddingSize(test.packetSize, test.mtu); got != test.want {
+			t.Errorf("paddingSize(%d, %d) = %d, want %d", test.packetSize, test.mtu, got, test.want)
+		}
+	}
+}
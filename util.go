@@ -3,6 +3,7 @@ package wireguard
 import (
 	"crypto/subtle"
 	"encoding/base64"
+	"errors"
 
 	"golang.org/x/crypto/blake2s"
 )
@@ -38,6 +39,9 @@ func decodeBase64(dst []byte, src string) error {
 	if err != nil {
 		return err
 	}
+	if len(slice) != len(dst) {
+		return errors.New("invalid key length")
+	}
 
 	copy(dst, slice)
 	return nil
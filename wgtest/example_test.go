@@ -0,0 +1,24 @@
+package wgtest_test
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/1stship/wireguard-oneshot"
+	"github.com/1stship/wireguard-oneshot/wgtest"
+)
+
+func ExampleNewServer() {
+	server := wgtest.NewServer(func(datagram *wireguard.Datagram) []byte {
+		return bytes.ToUpper(datagram.Payload)
+	})
+	defer server.Close()
+
+	response, err := wireguard.UdpOneShot([]byte("hello"), wgtest.IpAddress, 7, server.Configuration())
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	fmt.Println(string(response))
+	// Output: HELLO
+}
@@ -0,0 +1,162 @@
+// Package wgtest provides an in-process WireGuard peer for tests, in the
+// manner of net/http/httptest.
+package wgtest
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/1stship/wireguard-oneshot"
+	"golang.org/x/crypto/curve25519"
+)
+
+const (
+	IpAddress       = "10.0.0.1" // address of the server inside the tunnel
+	ClientIpAddress = "10.0.0.2"
+)
+
+// Handler answers a datagram received through the tunnel. A nil reply sends
+// nothing back.
+type Handler func(datagram *wireguard.Datagram) []byte
+
+// Echo replies with the received payload.
+func Echo(datagram *wireguard.Datagram) []byte {
+	return datagram.Payload
+}
+
+// Server is a WireGuard responder on a loopback UDP port with generated keys,
+// accepting a single generated client key.
+type Server struct {
+	Endpoint         string
+	PrivateKey       string
+	PublicKey        string
+	ClientPrivateKey string
+	ClientPublicKey  string
+
+	handler  Handler
+	listener *wireguard.Listener
+
+	mutex   sync.Mutex
+	tunnels []*wireguard.Tunnel
+	wait    sync.WaitGroup
+}
+
+// NewServer starts a server calling handler for every datagram. It panics if
+// the server cannot be started, and should be closed when done.
+func NewServer(handler Handler) *Server {
+	server, err := newServer(handler)
+	if err != nil {
+		panic(fmt.Sprintf("wgtest: failed to start server: %v", err))
+	}
+	return server
+}
+
+func newServer(handler Handler) (*Server, error) {
+	server := &Server{handler: handler}
+
+	var err error
+	server.PrivateKey, server.PublicKey, err = GenerateKey()
+	if err != nil {
+		return nil, err
+	}
+	server.ClientPrivateKey, server.ClientPublicKey, err = GenerateKey()
+	if err != nil {
+		return nil, err
+	}
+
+	server.listener, err = wireguard.Listen(wireguard.ListenerConfiguration{
+		PrivateKey:    server.PrivateKey,
+		ListenAddress: "127.0.0.1:0",
+		IpAddress:     IpAddress,
+		Peers:         []string{server.ClientPublicKey},
+	})
+	if err != nil {
+		return nil, err
+	}
+	server.Endpoint = server.listener.Addr().String()
+
+	server.wait.Add(1)
+	go server.accept()
+	return server, nil
+}
+
+// Configuration returns a client configuration for the server.
+func (s *Server) Configuration() wireguard.Configuration {
+	return wireguard.Configuration{
+		PrivateKey:      s.ClientPrivateKey,
+		PublicKey:       s.PublicKey,
+		Endpoint:        s.Endpoint,
+		ClientIpAddress: ClientIpAddress,
+		Timeout:         5 * time.Second,
+	}
+}
+
+func (s *Server) Close() error {
+	err := s.listener.Close()
+
+	s.mutex.Lock()
+	for _, tunnel := range s.tunnels {
+		tunnel.Close()
+	}
+	s.mutex.Unlock()
+
+	s.wait.Wait()
+	return err
+}
+
+func (s *Server) accept() {
+	defer s.wait.Done()
+	for {
+		tunnel, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+
+		s.mutex.Lock()
+		s.tunnels = append(s.tunnels, tunnel)
+		s.mutex.Unlock()
+
+		s.wait.Add(1)
+		go s.serve(tunnel)
+	}
+}
+
+func (s *Server) serve(tunnel *wireguard.Tunnel) {
+	defer s.wait.Done()
+	for {
+		datagram, err := tunnel.Receive()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+
+		reply := s.handler(datagram)
+		if reply != nil {
+			tunnel.Reply(datagram, reply)
+		}
+	}
+}
+
+// GenerateKey returns a new base64 encoded key pair.
+func GenerateKey() (privateKey string, publicKey string, err error) {
+	var sk [32]byte
+	_, err = rand.Read(sk[:])
+	if err != nil {
+		return "", "", err
+	}
+	sk[0] &= 248
+	sk[31] = (sk[31] & 127) | 64
+
+	pk, err := curve25519.X25519(sk[:], curve25519.Basepoint)
+	if err != nil {
+		return "", "", err
+	}
+	return base64.StdEncoding.EncodeToString(sk[:]), base64.StdEncoding.EncodeToString(pk), nil
+}
@@ -1,22 +1,40 @@
 package wireguard
 
+import (
+	"fmt"
+	"io"
+	"time"
+)
+
 type Configuration struct {
     PrivateKey     string
     PublicKey      string
     Endpoint             string 
 	ClientIpAddress      string 
+	Timeout              time.Duration // time to wait for the handshake response and the reply, zero means no limit
+	PresharedKey         string        // optional, base64 like the other keys
+	PersistentKeepalive  time.Duration // interval of keepalives sent when the tunnel is otherwise idle, zero disables them
+	Rand                 io.Reader        // entropy for keys, indices, source ports and IP IDs, nil means crypto/rand
+	Now                  func() time.Time // clock for handshake timestamps and key lifetimes, nil means time.Now
+	MTU                  int              // largest inner packet, zero means DefaultMTU
 }
 
-func UdpOneShot(payload []byte, destinationIpAddress string, destinationPort int, config Configuration) ([]byte, error) {
-	keypair, conn, err := handshake(config)
-	if err != nil {
-		return nil, err
+func effectiveMTU(configured int) (int, error) {
+	if configured == 0 {
+		return DefaultMTU, nil
 	}
+	if configured < MinMTU || configured > MaxMTU {
+		return 0, fmt.Errorf("%w: %d is outside %d to %d", ErrInvalidMTU, configured, MinMTU, MaxMTU)
+	}
+	return configured, nil
+}
 
-	ret, err := udpOneShot(payload, destinationIpAddress, destinationPort, config.ClientIpAddress, keypair, conn)
+func UdpOneShot(payload []byte, destinationIpAddress string, destinationPort int, config Configuration) ([]byte, error) {
+	client, err := NewClient(config)
 	if err != nil {
 		return nil, err
 	}
+	defer client.Close()
 
-	return ret, nil
+	return client.UdpOneShot(payload, destinationIpAddress, destinationPort)
 }
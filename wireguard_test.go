@@ -0,0 +1,1400 @@
+package wireguard_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"github.com/1stship/wireguard-oneshot"
+	"github.com/1stship/wireguard-oneshot/wgtest"
+)
+
+func TestUdpOneShot(t *testing.T) {
+	server := wgtest.NewServer(wgtest.Echo)
+	defer server.Close()
+
+	response, err := wireguard.UdpOneShot([]byte("hello"), wgtest.IpAddress, 7, server.Configuration())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(response) != "hello" {
+		t.Errorf("response = %q, want %q", response, "hello")
+	}
+}
+
+func TestTunnelExchanges(t *testing.T) {
+	server := wgtest.NewServer(func(datagram *wireguard.Datagram) []byte {
+		return append([]byte("echo:"), datagram.Payload...)
+	})
+	defer server.Close()
+
+	tunnel, err := wireguard.Dial(server.Configuration())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tunnel.Close()
+
+	for _, size := range []int{0, 1, 15, 16, 17, 1000, wireguard.MaxPayloadSize - len("echo:")} {
+		payload := bytes.Repeat([]byte{'x'}, size)
+		tunnel.SetReadDeadline(time.Now().Add(5 * time.Second))
+		response, err := tunnel.UdpOneShot(payload, wgtest.IpAddress, 7)
+		if err != nil {
+			t.Fatalf("size %d: %v", size, err)
+		}
+		if want := append([]byte("echo:"), payload...); !bytes.Equal(response, want) {
+			t.Errorf("size %d: response of %d bytes, want %d", size, len(response), len(want))
+		}
+	}
+}
+
+func TestMTU(t *testing.T) {
+	server := wgtest.NewServer(func(datagram *wireguard.Datagram) []byte {
+		return []byte(fmt.Sprint(len(datagram.Payload)))
+	})
+	defer server.Close()
+
+	config := server.Configuration()
+	config.MTU = 1280
+	tunnel, err := wireguard.Dial(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tunnel.Close()
+
+	largest := config.MTU - wireguard.IpHeaderSize - wireguard.UdpHeaderSize
+	response, err := tunnel.Exchange(make([]byte, largest), wgtest.IpAddress, 7, time.Now().Add(5*time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(response) != fmt.Sprint(largest) {
+		t.Errorf("server got %s bytes, want %d", response, largest)
+	}
+
+	_, err = tunnel.Exchange(make([]byte, largest+1), wgtest.IpAddress, 7, time.Now().Add(5*time.Second))
+	if !errors.Is(err, wireguard.ErrPayloadTooLarge) {
+		t.Errorf("err = %v, want ErrPayloadTooLarge", err)
+	}
+}
+
+func TestReplySourceAddress(t *testing.T) {
+	server := wgtest.NewServer(wgtest.Echo)
+	defer server.Close()
+
+	tunnel, err := wireguard.Dial(server.Configuration())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tunnel.Close()
+
+	err = tunnel.Send([]byte("ping"), wgtest.IpAddress, 5353)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tunnel.SetReadDeadline(time.Now().Add(5 * time.Second))
+	datagram, err := tunnel.Receive()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if datagram.SourceIpAddress != wgtest.IpAddress || datagram.SourcePort != 5353 {
+		t.Errorf("reply from %s:%d, want %s:5353", datagram.SourceIpAddress, datagram.SourcePort, wgtest.IpAddress)
+	}
+	if datagram.DestinationIpAddress != wgtest.ClientIpAddress {
+		t.Errorf("reply to %s, want %s", datagram.DestinationIpAddress, wgtest.ClientIpAddress)
+	}
+}
+
+func TestExchangeSourcePort(t *testing.T) {
+	server := wgtest.NewServer(func(datagram *wireguard.Datagram) []byte {
+		return []byte(fmt.Sprint(datagram.SourcePort))
+	})
+	defer server.Close()
+
+	tunnel, err := wireguard.Dial(server.Configuration())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tunnel.Close()
+
+	options := wireguard.PacketOptions{SourcePort: 4000, TTL: 8, DSCP: 46}
+	response, err := tunnel.ExchangeWithOptions([]byte("hello"), wgtest.IpAddress, 7, time.Now().Add(5*time.Second), options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(response) != "4000" {
+		t.Errorf("sent from port %s, want 4000", response)
+	}
+
+	conn, err := tunnel.ListenPacket(4000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	_, err = tunnel.ExchangeWithOptions([]byte("hello"), wgtest.IpAddress, 7, time.Now().Add(5*time.Second), options)
+	if !errors.Is(err, wireguard.ErrPortInUse) {
+		t.Errorf("err = %v, want ErrPortInUse", err)
+	}
+}
+
+func TestTimeout(t *testing.T) {
+	server := wgtest.NewServer(func(datagram *wireguard.Datagram) []byte {
+		return nil
+	})
+	defer server.Close()
+
+	config := server.Configuration()
+	config.Timeout = 200 * time.Millisecond
+	_, err := wireguard.UdpOneShot([]byte("hello"), wgtest.IpAddress, 7, config)
+
+	var netErr net.Error
+	if !errors.As(err, &netErr) || !netErr.Timeout() {
+		t.Errorf("err = %v, want a timeout", err)
+	}
+}
+
+func TestUnknownPeer(t *testing.T) {
+	server := wgtest.NewServer(wgtest.Echo)
+	defer server.Close()
+
+	config := server.Configuration()
+	config.PrivateKey, _, _ = wgtest.GenerateKey()
+	config.Timeout = 200 * time.Millisecond
+	_, err := wireguard.Dial(config)
+
+	var netErr net.Error
+	if !errors.As(err, &netErr) || !netErr.Timeout() {
+		t.Errorf("err = %v, want a handshake timeout", err)
+	}
+}
+
+func TestInvalidKeys(t *testing.T) {
+	server := wgtest.NewServer(wgtest.Echo)
+	defer server.Close()
+
+	config := server.Configuration()
+	config.PrivateKey = "not a key"
+	_, err := wireguard.Dial(config)
+	if !errors.Is(err, wireguard.ErrInvalidPrivateKey) {
+		t.Errorf("err = %v, want ErrInvalidPrivateKey", err)
+	}
+
+	config = server.Configuration()
+	config.PublicKey = "c2hvcnQ="
+	_, err = wireguard.Dial(config)
+	if !errors.Is(err, wireguard.ErrInvalidPublicKey) {
+		t.Errorf("err = %v, want ErrInvalidPublicKey", err)
+	}
+}
+
+func TestResume(t *testing.T) {
+	server := wgtest.NewServer(wgtest.Echo)
+	defer server.Close()
+
+	config := server.Configuration()
+	tunnel, err := wireguard.Dial(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tunnel.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = tunnel.UdpOneShot([]byte("first"), wgtest.IpAddress, 7)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	state := tunnel.State()
+	tunnel.Close()
+	if state.ReceiveNonce == 0 {
+		t.Error("the received reply is not in the state")
+	}
+
+	resumed, err := wireguard.Resume(config, state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resumed.Close()
+
+	resumed.SetReadDeadline(time.Now().Add(5 * time.Second))
+	response, err := resumed.UdpOneShot([]byte("second"), wgtest.IpAddress, 7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(response) != "second" {
+		t.Errorf("response = %q, want %q", response, "second")
+	}
+
+	state.Created = time.Now().Add(-wireguard.RejectAfterTime)
+	_, err = wireguard.Resume(config, state)
+	if !errors.Is(err, wireguard.ErrSessionExpired) {
+		t.Errorf("err = %v, want ErrSessionExpired", err)
+	}
+}
+
+func TestEntropyFailure(t *testing.T) {
+	server := wgtest.NewServer(wgtest.Echo)
+	defer server.Close()
+
+	config := server.Configuration()
+	config.Rand = iotest.ErrReader(errors.New("no entropy"))
+	_, err := wireguard.Dial(config)
+	if !errors.Is(err, wireguard.ErrEntropy) {
+		t.Errorf("Dial: err = %v, want ErrEntropy", err)
+	}
+
+	// enough for the ephemeral key and the sender index, not for a source port
+	config.Rand = io.MultiReader(io.LimitReader(rand.Reader, 32+4), iotest.ErrReader(errors.New("no entropy")))
+	tunnel, err := wireguard.Dial(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tunnel.Close()
+
+	err = tunnel.Send([]byte("hello"), wgtest.IpAddress, 7)
+	if !errors.Is(err, wireguard.ErrEntropy) {
+		t.Errorf("Send: err = %v, want ErrEntropy", err)
+	}
+}
+
+func TestClock(t *testing.T) {
+	server := wgtest.NewServer(wgtest.Echo)
+	defer server.Close()
+
+	config := server.Configuration()
+	tunnel, err := wireguard.Dial(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	state := tunnel.State()
+	tunnel.Close()
+
+	config.Now = func() time.Time {
+		return time.Now().Add(wireguard.RejectAfterTime)
+	}
+	_, err = wireguard.Resume(config, state)
+	if !errors.Is(err, wireguard.ErrSessionExpired) {
+		t.Errorf("err = %v, want ErrSessionExpired", err)
+	}
+}
+
+func TestClientConcurrent(t *testing.T) {
+	server := wgtest.NewServer(wgtest.Echo)
+	defer server.Close()
+
+	client, err := wireguard.NewClient(server.Configuration())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wait sync.WaitGroup
+	errs := make(chan error, 8)
+	for i := 0; i < cap(errs); i++ {
+		wait.Add(1)
+		go func(i int) {
+			defer wait.Done()
+			payload := fmt.Sprintf("request %d", i)
+			response, err := client.UdpOneShot([]byte(payload), wgtest.IpAddress, 7)
+			if err == nil && string(response) != payload {
+				err = fmt.Errorf("response = %q, want %q", response, payload)
+			}
+			errs <- err
+		}(i)
+	}
+	wait.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+// relay forwards datagrams between a client and endpoint, dropping those from
+// the client for which drop is true.
+func relay(t *testing.T, endpoint string, drop func(packet []byte) bool) string {
+	t.Helper()
+
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	server, err := net.ResolveUDPAddr("udp4", endpoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		var client *net.UDPAddr
+		buffer := make([]byte, wireguard.UdpRecieveSize)
+		for {
+			length, address, err := conn.ReadFromUDP(buffer)
+			if err != nil {
+				return
+			}
+
+			if address.String() == server.String() {
+				if client != nil {
+					conn.WriteToUDP(buffer[:length], client)
+				}
+				continue
+			}
+
+			client = address
+			if drop(buffer[:length]) {
+				continue
+			}
+			conn.WriteToUDP(buffer[:length], server)
+		}
+	}()
+
+	return conn.LocalAddr().String()
+}
+
+// The relay only answers the latest socket it heard from, so connections on
+// tunnels of their own would lose their replies.
+func TestClientListenPacket(t *testing.T) {
+	server := wgtest.NewServer(wgtest.Echo)
+	defer server.Close()
+
+	config := server.Configuration()
+	config.Endpoint = relay(t, server.Endpoint, func([]byte) bool { return false })
+	client, err := wireguard.NewClient(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	var conns []net.PacketConn
+	for i := 0; i < 2; i++ {
+		conn, err := client.ListenPacket(0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		conns = append(conns, conn)
+	}
+	if conns[0].LocalAddr().String() == conns[1].LocalAddr().String() {
+		t.Fatalf("both connections on %v", conns[0].LocalAddr())
+	}
+
+	echo := &net.UDPAddr{IP: net.ParseIP(wgtest.IpAddress), Port: 7}
+	send := func(conn net.PacketConn, payload string) {
+		t.Helper()
+		_, err := conn.WriteTo([]byte(payload), echo)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	receive := func(conn net.PacketConn, payload string) {
+		t.Helper()
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		buffer := make([]byte, 1500)
+		n, _, err := conn.ReadFrom(buffer)
+		if err != nil {
+			t.Fatalf("%s: %v", payload, err)
+		}
+		if string(buffer[:n]) != payload {
+			t.Errorf("ReadFrom = %q, want %q", buffer[:n], payload)
+		}
+	}
+	send(conns[0], "first")
+	send(conns[1], "second")
+	receive(conns[0], "first")
+	receive(conns[1], "second")
+
+	// closing a connection leaves the tunnel to the others
+	conns[0].Close()
+	send(conns[1], "after close")
+	receive(conns[1], "after close")
+	_, err = client.Exchange([]byte("exchange"), wgtest.IpAddress, 7, time.Now().Add(5*time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	send(conns[1], "after exchange")
+	receive(conns[1], "after exchange")
+}
+
+// keepalives counts the keepalives a client sends through a relay.
+func keepalives(t *testing.T, endpoint string) (string, func() int32) {
+	var count int32
+	address := relay(t, endpoint, func(packet []byte) bool {
+		if len(packet) == wireguard.MessageTransportSize && packet[0] == wireguard.MessageTransportType {
+			atomic.AddInt32(&count, 1)
+		}
+		return false
+	})
+	return address, func() int32 { return atomic.LoadInt32(&count) }
+}
+
+func TestPersistentKeepalive(t *testing.T) {
+	server := wgtest.NewServer(wgtest.Echo)
+	defer server.Close()
+
+	config := server.Configuration()
+	var sent func() int32
+	config.Endpoint, sent = keepalives(t, server.Endpoint)
+	config.PersistentKeepalive = 200 * time.Millisecond
+	tunnel, err := wireguard.Dial(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tunnel.Close()
+
+	time.Sleep(500 * time.Millisecond)
+	if n := sent(); n < 1 || n > 3 {
+		t.Fatalf("%d keepalives in 500ms at an interval of 200ms", n)
+	}
+
+	// traffic more often than the interval postpones the keepalive
+	before := sent()
+	tunnel.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for i := 0; i < 10; i++ {
+		_, err = tunnel.UdpOneShot([]byte("hello"), wgtest.IpAddress, 7)
+		if err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if n := sent() - before; n != 0 {
+		t.Errorf("%d keepalives while sending", n)
+	}
+
+	before = sent()
+	time.Sleep(500 * time.Millisecond)
+	if sent() == before {
+		t.Error("no keepalive after the traffic stopped")
+	}
+}
+
+// Data received and not answered within KEEPALIVE_TIMEOUT gets a keepalive, so
+// the peer knows its data arrived.
+func TestPassiveKeepalive(t *testing.T) {
+	if testing.Short() {
+		t.Skip("waits for KEEPALIVE_TIMEOUT")
+	}
+
+	server := wgtest.NewServer(wgtest.Echo)
+	defer server.Close()
+
+	config := server.Configuration()
+	var sent func() int32
+	config.Endpoint, sent = keepalives(t, server.Endpoint)
+	tunnel, err := wireguard.Dial(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tunnel.Close()
+
+	// the reply to data we send next is answered by that data
+	tunnel.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = tunnel.UdpOneShot([]byte("hello"), wgtest.IpAddress, 7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(wireguard.KeepaliveTimeout / 2)
+	tunnel.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = tunnel.UdpOneShot([]byte("hello"), wgtest.IpAddress, 7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(wireguard.KeepaliveTimeout / 2)
+	if n := sent(); n != 0 {
+		t.Fatalf("%d keepalives while sending", n)
+	}
+
+	// the last reply is not
+	time.Sleep(wireguard.KeepaliveTimeout/2 + time.Second)
+	if n := sent(); n != 1 {
+		t.Errorf("%d keepalives after KEEPALIVE_TIMEOUT, want 1", n)
+	}
+}
+
+func TestHandshakeRetransmit(t *testing.T) {
+	server := wgtest.NewServer(wgtest.Echo)
+	defer server.Close()
+
+	config := server.Configuration()
+	dropped := false
+	config.Endpoint = relay(t, server.Endpoint, func([]byte) bool {
+		// only the first initiation
+		if dropped {
+			return false
+		}
+		dropped = true
+		return true
+	})
+	config.Timeout = 0
+
+	start := time.Now()
+	tunnel, err := wireguard.Dial(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tunnel.Close()
+
+	if elapsed := time.Since(start); elapsed < wireguard.RekeyTimeout {
+		t.Errorf("handshake done after %v, before the initiation could have been sent again", elapsed)
+	}
+
+	tunnel.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = tunnel.UdpOneShot([]byte("hello"), wgtest.IpAddress, 7)
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestClientCloseWhileDialing(t *testing.T) {
+	server := wgtest.NewServer(wgtest.Echo)
+	defer server.Close()
+
+	// nothing reaches the server
+	config := server.Configuration()
+	config.Endpoint = relay(t, server.Endpoint, func([]byte) bool { return true })
+	config.Timeout = time.Second
+	client, err := wireguard.NewClient(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	errs := make(chan error, 2)
+	for i := 0; i < cap(errs); i++ {
+		go func() {
+			_, err := client.UdpOneShot([]byte("hello"), wgtest.IpAddress, 7)
+			errs <- err
+		}()
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	closed := make(chan error)
+	go func() {
+		closed <- client.Close()
+	}()
+	select {
+	case <-closed:
+	case <-time.After(500 * time.Millisecond):
+		t.Error("Close waited for the handshake")
+	}
+
+	// both exchanges end with the one handshake
+	for i := 0; i < cap(errs); i++ {
+		select {
+		case err := <-errs:
+			var netErr net.Error
+			if !errors.As(err, &netErr) || !netErr.Timeout() {
+				t.Errorf("err = %v, want a timeout", err)
+			}
+		case <-time.After(3 * time.Second):
+			t.Fatal("exchange still waiting after the handshake timed out")
+		}
+	}
+}
+
+// The deadline of each exchange, not the configured timeout, bounds the
+// handshake of the shared tunnel.
+func TestClientExchangeDeadlineBoundsHandshake(t *testing.T) {
+	server := wgtest.NewServer(wgtest.Echo)
+	defer server.Close()
+
+	var blocked int32 = 1
+	config := server.Configuration()
+	config.Endpoint = relay(t, server.Endpoint, func(packet []byte) bool {
+		if atomic.LoadInt32(&blocked) == 1 {
+			return true
+		}
+		if packet[0] == wireguard.MessageInitiationType {
+			time.Sleep(100 * time.Millisecond)
+		}
+		return false
+	})
+	config.Timeout = time.Minute
+	client, err := wireguard.NewClient(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	start := time.Now()
+	_, err = client.Exchange([]byte("hello"), wgtest.IpAddress, 7, time.Now().Add(200*time.Millisecond))
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("err = %v, want os.ErrDeadlineExceeded", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("exchange returned after %v", elapsed)
+	}
+
+	// the handshake started by the first exchange ends within its deadline
+	time.Sleep(200 * time.Millisecond)
+	atomic.StoreInt32(&blocked, 0)
+	client.Close()
+
+	config.Timeout = 50 * time.Millisecond
+	client, err = wireguard.NewClient(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	_, err = client.Exchange([]byte("hello"), wgtest.IpAddress, 7, time.Now().Add(5*time.Second))
+	if err != nil {
+		t.Errorf("exchange with a deadline past the configured timeout: %v", err)
+	}
+}
+
+// A tunnel dialed after Close is closed at once, and the Client stays closed.
+func TestClientCloseBeforeDialCompletes(t *testing.T) {
+	server := wgtest.NewServer(wgtest.Echo)
+	defer server.Close()
+
+	// hold back the initiation until Close has returned
+	config := server.Configuration()
+	config.Endpoint = relay(t, server.Endpoint, func(packet []byte) bool {
+		if packet[0] == wireguard.MessageInitiationType {
+			time.Sleep(300 * time.Millisecond)
+		}
+		return false
+	})
+	client, err := wireguard.NewClient(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	errs := make(chan error, 1)
+	go func() {
+		_, err := client.Exchange([]byte("hello"), wgtest.IpAddress, 7, time.Now().Add(5*time.Second))
+		errs <- err
+	}()
+	time.Sleep(100 * time.Millisecond)
+	client.Close()
+
+	select {
+	case err := <-errs:
+		if !errors.Is(err, net.ErrClosed) {
+			t.Errorf("err = %v, want net.ErrClosed", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("exchange still waiting after the handshake")
+	}
+
+	_, err = client.Exchange([]byte("hello"), wgtest.IpAddress, 7, time.Now().Add(5*time.Second))
+	if !errors.Is(err, net.ErrClosed) {
+		t.Errorf("exchange after Close: err = %v, want net.ErrClosed", err)
+	}
+	_, err = client.ListenPacket(0)
+	if !errors.Is(err, net.ErrClosed) {
+		t.Errorf("ListenPacket after Close: err = %v, want net.ErrClosed", err)
+	}
+}
+
+// testClientKeepsTunnel checks that an exchange failing with fail leaves the
+// shared tunnel to the exchanges in flight: a new tunnel would take over at the
+// server and their replies would not reach the old one.
+func testClientKeepsTunnel(t *testing.T, fail func(client *wireguard.Client) error) {
+	server := wgtest.NewServer(func(datagram *wireguard.Datagram) []byte {
+		if string(datagram.Payload) == "slow" {
+			time.Sleep(500 * time.Millisecond)
+		}
+		if string(datagram.Payload) == "ignored" {
+			return nil
+		}
+		return datagram.Payload
+	})
+	defer server.Close()
+
+	client, err := wireguard.NewClient(server.Configuration())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	_, err = client.Exchange([]byte("hello"), wgtest.IpAddress, 7, time.Now().Add(5*time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	slow := make(chan error)
+	go func() {
+		_, err := client.Exchange([]byte("slow"), wgtest.IpAddress, 7, time.Now().Add(5*time.Second))
+		slow <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	if fail(client) == nil {
+		t.Fatal("the failing exchange succeeded")
+	}
+
+	_, err = client.Exchange([]byte("hello"), wgtest.IpAddress, 7, time.Now().Add(5*time.Second))
+	if err != nil {
+		t.Error(err)
+	}
+	if err := <-slow; err != nil {
+		t.Errorf("exchange in flight: %v", err)
+	}
+}
+
+func TestClientKeepsTunnelAfterOversizePayload(t *testing.T) {
+	testClientKeepsTunnel(t, func(client *wireguard.Client) error {
+		_, err := client.Exchange(make([]byte, wireguard.MaxPayloadSize+1), wgtest.IpAddress, 7, time.Now().Add(5*time.Second))
+		if !errors.Is(err, wireguard.ErrPayloadTooLarge) {
+			t.Errorf("err = %v, want ErrPayloadTooLarge", err)
+		}
+		return err
+	})
+}
+
+func TestClientKeepsTunnelAfterTimeout(t *testing.T) {
+	testClientKeepsTunnel(t, func(client *wireguard.Client) error {
+		_, err := client.Exchange([]byte("ignored"), wgtest.IpAddress, 7, time.Now().Add(100*time.Millisecond))
+		if !errors.Is(err, os.ErrDeadlineExceeded) {
+			t.Errorf("err = %v, want os.ErrDeadlineExceeded", err)
+		}
+		return err
+	})
+}
+
+func TestNewClientValidation(t *testing.T) {
+	server := wgtest.NewServer(wgtest.Echo)
+	defer server.Close()
+
+	config := server.Configuration()
+	config.PresharedKey = "not a key"
+	_, err := wireguard.NewClient(config)
+	if !errors.Is(err, wireguard.ErrInvalidPresharedKey) {
+		t.Errorf("err = %v, want ErrInvalidPresharedKey", err)
+	}
+
+	config = server.Configuration()
+	config.ClientIpAddress = "10.0.0"
+	_, err = wireguard.NewClient(config)
+	if !errors.Is(err, wireguard.ErrInvalidAddress) {
+		t.Errorf("err = %v, want ErrInvalidAddress", err)
+	}
+
+	config = server.Configuration()
+	config.MTU = 100
+	_, err = wireguard.NewClient(config)
+	if !errors.Is(err, wireguard.ErrInvalidMTU) {
+		t.Errorf("err = %v, want ErrInvalidMTU", err)
+	}
+
+	// a low order point gives no shared secret
+	config = server.Configuration()
+	config.PublicKey = "AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA="
+	_, err = wireguard.NewClient(config)
+	if !errors.Is(err, wireguard.ErrInvalidPublicKey) {
+		t.Errorf("err = %v, want ErrInvalidPublicKey", err)
+	}
+}
+
+func TestExchangeConcurrent(t *testing.T) {
+	server := wgtest.NewServer(wgtest.Echo)
+	defer server.Close()
+
+	tunnel, err := wireguard.Dial(server.Configuration())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tunnel.Close()
+
+	// every request goes to the same destination; only the source ports differ
+	var wait sync.WaitGroup
+	errs := make(chan error, 32)
+	for i := 0; i < cap(errs); i++ {
+		wait.Add(1)
+		go func(i int) {
+			defer wait.Done()
+			payload := fmt.Sprintf("request %d", i)
+			response, err := tunnel.Exchange([]byte(payload), wgtest.IpAddress, 7, time.Now().Add(5*time.Second))
+			if err == nil && string(response) != payload {
+				err = fmt.Errorf("response = %q, want %q", response, payload)
+			}
+			errs <- err
+		}(i)
+	}
+	wait.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestExchangeDeadline(t *testing.T) {
+	server := wgtest.NewServer(func(datagram *wireguard.Datagram) []byte {
+		if string(datagram.Payload) == "ignored" {
+			return nil
+		}
+		return datagram.Payload
+	})
+	defer server.Close()
+
+	tunnel, err := wireguard.Dial(server.Configuration())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tunnel.Close()
+
+	ignored := make(chan error, 1)
+	go func() {
+		_, err := tunnel.Exchange([]byte("ignored"), wgtest.IpAddress, 7, time.Now().Add(200*time.Millisecond))
+		ignored <- err
+	}()
+
+	// a request waiting for its deadline does not hold up the others
+	response, err := tunnel.Exchange([]byte("answered"), wgtest.IpAddress, 7, time.Now().Add(5*time.Second))
+	if err != nil || string(response) != "answered" {
+		t.Errorf("Exchange = %q, %v", response, err)
+	}
+
+	err = <-ignored
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("err = %v, want os.ErrDeadlineExceeded", err)
+	}
+}
+
+func TestClientExchangeContext(t *testing.T) {
+	server := wgtest.NewServer(func(datagram *wireguard.Datagram) []byte {
+		if string(datagram.Payload) == "ignored" {
+			return nil
+		}
+		return datagram.Payload
+	})
+	defer server.Close()
+
+	client, err := wireguard.NewClient(server.Configuration())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	response, err := client.ExchangeContext(ctx, []byte("answered"), wgtest.IpAddress, 7, wireguard.PacketOptions{})
+	if err != nil || string(response) != "answered" {
+		t.Errorf("ExchangeContext = %q, %v", response, err)
+	}
+
+	ctx, cancel = context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+	start := time.Now()
+	_, err = client.ExchangeContext(ctx, []byte("ignored"), wgtest.IpAddress, 7, wireguard.PacketOptions{})
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("err = %v, want context.Canceled", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("canceled exchange returned after %v", elapsed)
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	_, err = client.ExchangeContext(ctx, []byte("ignored"), wgtest.IpAddress, 7, wireguard.PacketOptions{})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("err = %v, want context.DeadlineExceeded", err)
+	}
+}
+
+func TestExchangeLeavesOthersToReceive(t *testing.T) {
+	server := wgtest.NewServer(wgtest.Echo)
+	defer server.Close()
+
+	tunnel, err := wireguard.Dial(server.Configuration())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tunnel.Close()
+
+	err = tunnel.Send([]byte("sent"), wgtest.IpAddress, 7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response, err := tunnel.Exchange([]byte("exchanged"), wgtest.IpAddress, 7, time.Now().Add(5*time.Second))
+	if err != nil || string(response) != "exchanged" {
+		t.Errorf("Exchange = %q, %v", response, err)
+	}
+
+	tunnel.SetReadDeadline(time.Now().Add(5 * time.Second))
+	datagram, err := tunnel.Receive()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(datagram.Payload) != "sent" {
+		t.Errorf("Receive = %q, want %q", datagram.Payload, "sent")
+	}
+}
+
+func TestListenPacket(t *testing.T) {
+	server := wgtest.NewServer(wgtest.Echo)
+	defer server.Close()
+
+	tunnel, err := wireguard.Dial(server.Configuration())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tunnel.Close()
+
+	conn, err := tunnel.ListenPacket(5683)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	local := conn.LocalAddr().(*net.UDPAddr)
+	if local.String() != wgtest.ClientIpAddress+":5683" {
+		t.Errorf("LocalAddr = %v", local)
+	}
+
+	_, err = tunnel.ListenPacket(5683)
+	if !errors.Is(err, wireguard.ErrPortInUse) {
+		t.Errorf("second ListenPacket: err = %v, want ErrPortInUse", err)
+	}
+
+	echo := &net.UDPAddr{IP: net.ParseIP(wgtest.IpAddress), Port: 7}
+	_, err = conn.WriteTo([]byte("coap"), echo)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buffer := make([]byte, 1500)
+	n, address, err := conn.ReadFrom(buffer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buffer[:n]) != "coap" || address.String() != echo.String() {
+		t.Errorf("ReadFrom = %q from %v, want %q from %v", buffer[:n], address, "coap", echo)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	_, _, err = conn.ReadFrom(buffer)
+	var netErr net.Error
+	if !errors.As(err, &netErr) || !netErr.Timeout() {
+		t.Errorf("err = %v, want a timeout", err)
+	}
+
+	conn.Close()
+	_, _, err = conn.ReadFrom(buffer)
+	if !errors.Is(err, net.ErrClosed) {
+		t.Errorf("err = %v, want net.ErrClosed", err)
+	}
+
+	// the port is free again
+	conn, err = tunnel.ListenPacket(5683)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+}
+
+// testClock runs with the system clock from an offset moved by advance.
+type testClock struct {
+	mutex  sync.Mutex
+	offset time.Duration
+}
+
+func (c *testClock) now() time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return time.Now().Add(c.offset)
+}
+
+func (c *testClock) advance(d time.Duration) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.offset += d
+}
+
+func TestRekeyAfterTime(t *testing.T) {
+	server := wgtest.NewServer(wgtest.Echo)
+	defer server.Close()
+
+	clock := new(testClock)
+	config := server.Configuration()
+	config.Now = clock.now
+	tunnel, err := wireguard.Dial(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tunnel.Close()
+	first := tunnel.State()
+
+	tunnel.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = tunnel.UdpOneShot([]byte("hello"), wgtest.IpAddress, 7)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// sending on the old keypair starts the handshake and still gets its reply
+	clock.advance(wireguard.RekeyAfterTime)
+	_, err = tunnel.UdpOneShot([]byte("hello"), wgtest.IpAddress, 7)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for tunnel.State().LocalIndex == first.LocalIndex {
+		if time.Since(first.Created) > 5*time.Second {
+			t.Fatal("no rekey after REKEY_AFTER_TIME")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !tunnel.Created().After(first.Created.Add(wireguard.RekeyAfterTime)) {
+		t.Errorf("new keypair created at %v, want after %v", tunnel.Created(), first.Created.Add(wireguard.RekeyAfterTime))
+	}
+
+	_, err = tunnel.UdpOneShot([]byte("hello"), wgtest.IpAddress, 7)
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+// The rekey completes before the listener has a tunnel for the first keypair.
+func TestRekeyBeforeFirstMessage(t *testing.T) {
+	server := wgtest.NewServer(wgtest.Echo)
+	defer server.Close()
+
+	clock := new(testClock)
+	config := server.Configuration()
+	config.Now = clock.now
+	tunnel, err := wireguard.Dial(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tunnel.Close()
+	first := tunnel.State()
+
+	clock.advance(wireguard.RekeyAfterTime)
+	tunnel.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for i := 0; i < 3; i++ {
+		_, err = tunnel.UdpOneShot([]byte("hello"), wgtest.IpAddress, 7)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if tunnel.State().LocalIndex == first.LocalIndex {
+		t.Error("no rekey after REKEY_AFTER_TIME")
+	}
+}
+
+func TestRejectAfterTime(t *testing.T) {
+	server := wgtest.NewServer(wgtest.Echo)
+	defer server.Close()
+
+	var blocked int32
+	clock := new(testClock)
+	config := server.Configuration()
+	config.Endpoint = relay(t, server.Endpoint, func([]byte) bool { return atomic.LoadInt32(&blocked) == 1 })
+	config.Now = clock.now
+	tunnel, err := wireguard.Dial(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tunnel.Close()
+
+	// the peer is gone: the expired keypair must not be used while rekeying
+	// fails, until the tunnel gives up after REKEY_ATTEMPT_TIME
+	atomic.StoreInt32(&blocked, 1)
+	clock.advance(wireguard.RejectAfterTime)
+
+	sent := make(chan error)
+	go func() {
+		sent <- tunnel.Send([]byte("hello"), wgtest.IpAddress, 7)
+	}()
+
+	select {
+	case err := <-sent:
+		t.Fatalf("Send returned %v while rekeying", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	clock.advance(wireguard.RekeyAttemptTime)
+	select {
+	case err := <-sent:
+		if !errors.Is(err, wireguard.ErrSessionExpired) {
+			t.Errorf("err = %v, want ErrSessionExpired", err)
+		}
+	case <-time.After(wireguard.RekeyTimeout + time.Second):
+		t.Fatal("Send still waiting after REKEY_ATTEMPT_TIME")
+	}
+}
+
+// While rekeying fails, sending still ends at the deadline of the caller.
+func TestRejectAfterTimeDeadline(t *testing.T) {
+	server := wgtest.NewServer(wgtest.Echo)
+	defer server.Close()
+
+	var blocked int32
+	clock := new(testClock)
+	config := server.Configuration()
+	config.Endpoint = relay(t, server.Endpoint, func([]byte) bool { return atomic.LoadInt32(&blocked) == 1 })
+	config.Now = clock.now
+	tunnel, err := wireguard.Dial(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tunnel.Close()
+
+	atomic.StoreInt32(&blocked, 1)
+	clock.advance(wireguard.RejectAfterTime)
+
+	start := time.Now()
+	_, err = tunnel.Exchange([]byte("hello"), wgtest.IpAddress, 7, time.Now().Add(200*time.Millisecond))
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("Exchange err = %v, want os.ErrDeadlineExceeded", err)
+	}
+
+	conn, err := tunnel.ListenPacket(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetWriteDeadline(time.Now().Add(200 * time.Millisecond))
+	_, err = conn.WriteTo([]byte("hello"), &net.UDPAddr{IP: net.ParseIP(wgtest.IpAddress), Port: 7})
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("WriteTo err = %v, want os.ErrDeadlineExceeded", err)
+	}
+
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("sending took %v past the deadlines", elapsed)
+	}
+}
+
+// serveEcho answers every datagram on the tunnels accepted by listener.
+func serveEcho(listener *wireguard.Listener) {
+	for {
+		tunnel, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			for {
+				datagram, err := tunnel.Receive()
+				if errors.Is(err, net.ErrClosed) {
+					return
+				}
+				if err == nil {
+					tunnel.Reply(datagram, datagram.Payload)
+				}
+			}
+		}()
+	}
+}
+
+// A restarted peer drops our transport messages until we handshake again,
+// which we do when nothing comes back for KEEPALIVE_TIMEOUT + REKEY_TIMEOUT.
+func TestNewHandshakeAfterPeerRestart(t *testing.T) {
+	if testing.Short() {
+		t.Skip("waits for KEEPALIVE_TIMEOUT + REKEY_TIMEOUT")
+	}
+
+	privateKey, publicKey, err := wgtest.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientPrivateKey, clientPublicKey, err := wgtest.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	listen := func(address string) *wireguard.Listener {
+		listener, err := wireguard.Listen(wireguard.ListenerConfiguration{
+			PrivateKey:    privateKey,
+			ListenAddress: address,
+			IpAddress:     wgtest.IpAddress,
+			Peers:         []string{clientPublicKey},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		go serveEcho(listener)
+		return listener
+	}
+
+	listener := listen("127.0.0.1:0")
+	client, err := wireguard.NewClient(wireguard.Configuration{
+		PrivateKey:      clientPrivateKey,
+		PublicKey:       publicKey,
+		Endpoint:        listener.Addr().String(),
+		ClientIpAddress: wgtest.ClientIpAddress,
+		Timeout:         5 * time.Second,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	_, err = client.Exchange([]byte("hello"), wgtest.IpAddress, 7, time.Now().Add(5*time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	listener.Close()
+	listener = listen(listener.Addr().String())
+	defer listener.Close()
+
+	restarted := time.Now()
+	_, err = client.Exchange([]byte("lost"), wgtest.IpAddress, 7, time.Now().Add(time.Second))
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("err = %v, want a timeout from the restarted peer", err)
+	}
+
+	for {
+		_, err = client.Exchange([]byte("hello"), wgtest.IpAddress, 7, time.Now().Add(time.Second))
+		if err == nil {
+			break
+		}
+		if time.Since(restarted) > wireguard.KeepaliveTimeout+2*wireguard.RekeyTimeout {
+			t.Fatalf("no new handshake after the peer restarted: %v", err)
+		}
+	}
+	if time.Since(restarted) < wireguard.KeepaliveTimeout+wireguard.RekeyTimeout {
+		t.Errorf("new handshake after %v, want KEEPALIVE_TIMEOUT + REKEY_TIMEOUT", time.Since(restarted))
+	}
+}
+
+// A forged message to the index of our response must not stand for the
+// initiator confirming the session.
+func TestListenerForgedFirstMessage(t *testing.T) {
+	privateKey, publicKey, err := wgtest.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientPrivateKey, clientPublicKey, err := wgtest.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	listener, err := wireguard.Listen(wireguard.ListenerConfiguration{
+		PrivateKey:    privateKey,
+		ListenAddress: "127.0.0.1:0",
+		IpAddress:     wgtest.IpAddress,
+		Peers:         []string{clientPublicKey},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	tunnel, err := wireguard.Dial(wireguard.Configuration{
+		PrivateKey:      clientPrivateKey,
+		PublicKey:       publicKey,
+		Endpoint:        listener.Addr().String(),
+		ClientIpAddress: wgtest.ClientIpAddress,
+		Timeout:         5 * time.Second,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tunnel.Close()
+
+	accepted := make(chan *wireguard.Tunnel, 1)
+	go func() {
+		tunnel, err := listener.Accept()
+		if err == nil {
+			accepted <- tunnel
+		}
+	}()
+
+	forger, err := net.Dial("udp4", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer forger.Close()
+	forged := make([]byte, wireguard.MessageTransportSize)
+	binary.LittleEndian.PutUint32(forged[0:4], wireguard.MessageTransportType)
+	binary.LittleEndian.PutUint32(forged[wireguard.MessageTransportOffsetReceiver:], tunnel.State().RemoteIndex)
+	_, err = forger.Write(forged)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-accepted:
+		t.Fatal("accepted a session on a forged message")
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	err = tunnel.Send([]byte("hello"), wgtest.IpAddress, 7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case peer := <-accepted:
+		defer peer.Close()
+		peer.SetReadDeadline(time.Now().Add(5 * time.Second))
+		datagram, err := peer.Receive()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(datagram.Payload) != "hello" {
+			t.Errorf("payload = %q, want hello", datagram.Payload)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("session not accepted on the first message")
+	}
+}
+
+func TestResponderRejectAfterTime(t *testing.T) {
+	privateKey, publicKey, err := wgtest.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientPrivateKey, clientPublicKey, err := wgtest.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clock := new(testClock)
+	listener, err := wireguard.Listen(wireguard.ListenerConfiguration{
+		PrivateKey:    privateKey,
+		ListenAddress: "127.0.0.1:0",
+		IpAddress:     wgtest.IpAddress,
+		Peers:         []string{clientPublicKey},
+		Now:           clock.now,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	tunnel, err := wireguard.Dial(wireguard.Configuration{
+		PrivateKey:      clientPrivateKey,
+		PublicKey:       publicKey,
+		Endpoint:        listener.Addr().String(),
+		ClientIpAddress: wgtest.ClientIpAddress,
+		Timeout:         5 * time.Second,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tunnel.Close()
+
+	// the first transport message confirms the session
+	err = tunnel.Send([]byte("hello"), wgtest.IpAddress, 7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	accepted, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the responder leaves rekeying to the initiator and stops at once
+	clock.advance(wireguard.RejectAfterTime)
+	err = accepted.Send([]byte("hello"), wgtest.ClientIpAddress, 7)
+	if !errors.Is(err, wireguard.ErrSessionExpired) {
+		t.Errorf("err = %v, want ErrSessionExpired", err)
+	}
+}